@@ -0,0 +1,69 @@
+// Package agentproto reads and writes the messages of the SSH agent protocol,
+// independent of the transport and the platform.
+package agentproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxMessageBytes is the size limit of a message, as in OpenSSH.
+const MaxMessageBytes = 16 << 20
+
+// ReadMessage reads one length prefixed agent message and returns it without the length.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(length[:])
+	if l == 0 || l > MaxMessageBytes {
+		return nil, errors.New("agent: invalid message length")
+	}
+	msg := make([]byte, l)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteMessage writes msg with its length in front.
+func WriteMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[4:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Relay forwards the requests read from client to upstream and the replies back, one message
+// at a time, until client is closed. It does not depend on the transport of either side,
+// e.g. client may be stdin and stdout and upstream a named pipe.
+func Relay(client, upstream io.ReadWriter) error {
+	for {
+		req, err := ReadMessage(client)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := WriteMessage(upstream, req); err != nil {
+			return err
+		}
+		reply, err := ReadMessage(upstream)
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("agent: upstream closed the connection")
+			}
+			return err
+		}
+		if err := WriteMessage(client, reply); err != nil {
+			return err
+		}
+	}
+}
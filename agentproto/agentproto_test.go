@@ -0,0 +1,159 @@
+package agentproto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// conn is a connection made of a reader and a writer, such as stdin and stdout.
+type conn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (c conn) Close() error {
+	c.WriteCloser.Close()
+	return c.ReadCloser.Close()
+}
+
+// ioPipes returns both ends of a connection made of two io.Pipes.
+func ioPipes() (conn, conn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return conn{r1, w2}, conn{r2, w1}
+}
+
+// osPipes returns both ends of a connection made of two os.Pipes.
+func osPipes(t *testing.T) (conn, conn) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn{r1, w2}, conn{r2, w1}
+}
+
+func TestReadWriteMessage(t *testing.T) {
+	var buf bytes.Buffer
+	msg := []byte{11, 1, 2, 3}
+	if err := WriteMessage(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 4, 11, 1, 2, 3}) {
+		t.Errorf("WriteMessage() wrote %v", buf.Bytes())
+	}
+	got, err := ReadMessage(&buf)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("ReadMessage() = %v, %v, want %v", got, err, msg)
+	}
+	if _, err := ReadMessage(&buf); err != io.EOF {
+		t.Errorf("ReadMessage() at the end = %v, want io.EOF", err)
+	}
+
+	tooLong := make([]byte, 4)
+	binary.BigEndian.PutUint32(tooLong, MaxMessageBytes+1)
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty message", []byte{0, 0, 0, 0}, nil},
+		{"too long", tooLong, nil},
+		{"truncated length", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"truncated message", []byte{0, 0, 0, 4, 11}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		_, err := ReadMessage(bytes.NewReader(tt.data))
+		if err == nil || (tt.want != nil && err != tt.want) {
+			t.Errorf("%s: ReadMessage() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func testRelay(t *testing.T, client, relayClient, relayUpstream, upstream conn) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		agent.ServeAgent(keyring, upstream)
+		upstream.Close()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- Relay(relayClient, relayUpstream)
+	}()
+
+	ag := agent.NewClient(client)
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "key" {
+		t.Fatalf("List() = %v, want the key of the upstream agent", keys)
+	}
+	pub, _ := ssh.NewPublicKey(priv.Public())
+	sig, err := ag.Sign(pub, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify([]byte("data"), sig); err != nil {
+		t.Error(err)
+	}
+	// a failure reply is relayed as well
+	if err := ag.Unlock([]byte("secret")); err == nil {
+		t.Error("Unlock() of an agent which is not locked succeeded")
+	}
+
+	client.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Relay() = %v, want nil after the client closed the connection", err)
+	}
+	relayUpstream.Close()
+}
+
+func TestRelayIOPipe(t *testing.T) {
+	client, relayClient := ioPipes()
+	relayUpstream, upstream := ioPipes()
+	testRelay(t, client, relayClient, relayUpstream, upstream)
+}
+
+func TestRelayOSPipe(t *testing.T) {
+	client, relayClient := osPipes(t)
+	relayUpstream, upstream := osPipes(t)
+	testRelay(t, client, relayClient, relayUpstream, upstream)
+}
+
+func TestRelayUpstreamClosed(t *testing.T) {
+	client, relayClient := ioPipes()
+	relayUpstream, upstream := ioPipes()
+	go func() {
+		// read the request and hang up without a reply
+		ReadMessage(upstream)
+		upstream.Close()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- Relay(relayClient, relayUpstream)
+	}()
+	go WriteMessage(client, []byte{11})
+	if err := <-done; err == nil {
+		t.Error("Relay() = nil, want an error when the upstream agent hangs up")
+	}
+	client.Close()
+}
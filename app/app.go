@@ -9,6 +9,7 @@ const (
 	WSL_SOCK    = "wincrypt-wsl.sock"
 	CYGWIN_SOCK = "wincrypt-cygwin.sock"
 	NAMED_PIPE  = "\\\\.\\pipe\\openssh-ssh-agent"
+	SUBMENU_SEP = "|"
 	APP_CYGWIN  = iota
 	APP_WSL
 	APP_WINSSH
@@ -18,7 +19,11 @@ const (
 	APP_XSHELL
 	APP_PUBKEY
 	APP_WSL2
-	MENU_QUIT
+	APP_PUBKEY_SYNC
+	APP_PUBKEY_RESTORE
+	APP_PUBKEY_EXPORT
+	APP_NEW_KEY = APP_PUBKEY_EXPORT + 0x20
+	MENU_QUIT   = APP_PUBKEY_EXPORT + 0x100
 )
 
 type Application interface {
@@ -30,23 +35,25 @@ type Application interface {
 type AppId int
 
 var appIdToName = map[AppId]string{
-	APP_CYGWIN:    "Cygwin",
-	APP_WSL:       "WSL",
-	APP_WINSSH:    "WinSSH",
-	APP_SECURECRT: "SecureCRT",
-	APP_PAGEANT:   "Pageant",
-	APP_XSHELL:    "XShell",
-	APP_HYPERV:    "Hyper-V",
+	APP_CYGWIN:      "Cygwin",
+	APP_WSL:         "WSL",
+	APP_WINSSH:      "WinSSH",
+	APP_SECURECRT:   "SecureCRT",
+	APP_PAGEANT:     "Pageant",
+	APP_XSHELL:      "XShell",
+	APP_HYPERV:      "Hyper-V",
+	APP_PUBKEY_SYNC: "IdentityFile",
 }
 
 var appIdToFullName = map[AppId]string{
-	APP_CYGWIN:    "Cygwin (MinGW64 & MSYS2)",
-	APP_WSL:       "Windows Subsystem for Linux",
-	APP_WINSSH:    "Windows OpenSSH",
-	APP_SECURECRT: "SecureCRT",
-	APP_PAGEANT:   "Pageant",
-	APP_XSHELL:    "XShell",
-	APP_HYPERV:    "Hyper-V",
+	APP_CYGWIN:      "Cygwin (MinGW64 & MSYS2)",
+	APP_WSL:         "Windows Subsystem for Linux",
+	APP_WINSSH:      "Windows OpenSSH",
+	APP_SECURECRT:   "SecureCRT",
+	APP_PAGEANT:     "Pageant",
+	APP_XSHELL:      "XShell",
+	APP_HYPERV:      "Hyper-V",
+	APP_PUBKEY_SYNC: "OpenSSH IdentityFile",
 }
 
 func (id AppId) String() string {
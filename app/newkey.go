@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+type newKeyPreset struct {
+	name     string
+	provider string
+	keyType  string
+	bits     int
+}
+
+var newKeyPresets = []newKeyPreset{
+	{"TPM (ECDSA P-256)", "tpm", "ecdsa", 256},
+	{"TPM (RSA 2048)", "tpm", "rsa", 2048},
+	{"Smart Card (RSA 2048)", "smartcard", "rsa", 2048},
+	{"Software (ECDSA P-256)", "software", "ecdsa", 256},
+	{"Software (RSA 3072)", "software", "rsa", 3072},
+}
+
+// NewKey creates keys with a self-signed certificate in a key storage provider.
+type NewKey struct {
+}
+
+func (s *NewKey) Run(ctx context.Context, handler func(conn io.ReadWriteCloser)) error {
+	return nil
+}
+
+func (*NewKey) AppId() AppId {
+	return APP_NEW_KEY
+}
+
+func (s *NewKey) Menu(register func(id AppId, name string, handler func())) {
+	for i, preset := range newKeyPresets {
+		preset := preset
+		register(s.AppId()+AppId(i), "New Key"+SUBMENU_SEP+preset.name, func() {
+			s.onClick(preset)
+		})
+	}
+}
+
+func defaultKeyName() string {
+	user := os.Getenv("USERNAME")
+	host, _ := os.Hostname()
+	return strings.ToLower(fmt.Sprintf("%s@%s", user, host))
+}
+
+func (s *NewKey) onClick(preset newKeyPreset) {
+	name := defaultKeyName()
+	if utils.MessageBox(
+		"New Key:",
+		"Create a "+preset.name+" key with a self-signed certificate <"+name+">?",
+		utils.MB_OKCANCEL,
+	) != utils.IDOK {
+		return
+	}
+	pub, err := sshagent.GenerateKey(&sshagent.KeyRequest{
+		Provider:   preset.provider,
+		Type:       preset.keyType,
+		Bits:       preset.bits,
+		CommonName: name,
+	})
+	if err != nil {
+		utils.MessageBox("Error:", err.Error(), utils.MB_ICONERROR)
+		return
+	}
+	text := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + name
+	if utils.MessageBox("New Key (OK to copy):", text, utils.MB_OKCANCEL) == utils.IDOK {
+		utils.SetClipBoard(text)
+	}
+}
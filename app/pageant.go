@@ -2,15 +2,20 @@ package app
 
 import (
 	"context"
+	"fmt"
+	"github.com/Microsoft/go-winio"
 	"github.com/buptczq/WinCryptSSHAgent/utils"
 	"io"
+	"net"
 	"os"
 	"sync"
 )
 
-type Pageant struct{}
+type Pageant struct {
+	pipeName string
+}
 
-func (*Pageant) Run(ctx context.Context, handler func(conn io.ReadWriteCloser)) error {
+func (s *Pageant) Run(ctx context.Context, handler func(conn io.ReadWriteCloser)) error {
 	debug := false
 	if os.Getenv("WCSA_DEBUG") == "1" {
 		debug = true
@@ -22,6 +27,15 @@ func (*Pageant) Run(ctx context.Context, handler func(conn io.ReadWriteCloser))
 	defer win.Close()
 
 	wg := new(sync.WaitGroup)
+	// named pipe of PuTTY 0.75 and later, the window still serves older clients
+	pipe, err := s.listenPipe()
+	if err != nil {
+		println("Pageant: named pipe error", err.Error())
+	} else {
+		defer pipe.Close()
+		go s.servePipe(pipe, handler, wg)
+	}
+
 	for {
 		conn, err := win.AcceptCtx(ctx)
 		if err != nil {
@@ -38,9 +52,55 @@ func (*Pageant) Run(ctx context.Context, handler func(conn io.ReadWriteCloser))
 	}
 }
 
+func (s *Pageant) listenPipe() (net.Listener, error) {
+	name, err := utils.PageantPipeName()
+	if err != nil {
+		return nil, err
+	}
+	sd, err := utils.PageantPipeSecurityDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	pipe, err := winio.ListenPipe(name, &winio.PipeConfig{SecurityDescriptor: sd})
+	if err != nil {
+		return nil, err
+	}
+	s.pipeName = name
+	return pipe, nil
+}
+
+func (s *Pageant) servePipe(pipe net.Listener, handler func(conn io.ReadWriteCloser), wg *sync.WaitGroup) {
+	for {
+		conn, err := pipe.Accept()
+		if err != nil {
+			if err != winio.ErrPipeListenerClosed {
+				println("Pageant: named pipe error", err.Error())
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			handler(conn)
+			wg.Done()
+		}()
+	}
+}
+
 func (*Pageant) AppId() AppId {
 	return APP_PAGEANT
 }
 
 func (s *Pageant) Menu(register func(id AppId, name string, handler func())) {
+	register(s.AppId(), "Show "+s.AppId().String()+" Settings", s.onClick)
+}
+
+func (s *Pageant) onClick() {
+	if s.pipeName != "" {
+		help := fmt.Sprintf(`IdentityAgent "%s"`, s.pipeName)
+		if utils.MessageBox(s.AppId().FullName()+" for OpenSSH config (OK to copy):", help, utils.MB_OKCANCEL) == utils.IDOK {
+			utils.SetClipBoard(help)
+		}
+	} else {
+		utils.MessageBox("Error:", s.AppId().String()+" named pipe doesn't work!", utils.MB_ICONWARNING)
+	}
 }
@@ -3,11 +3,25 @@ package app
 import (
 	"context"
 	"io"
+	"strings"
 
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
 	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+var exportFormatNames = map[string]string{
+	sshagent.ExportAuthorizedKeys: "OpenSSH (authorized_keys)",
+	sshagent.ExportRFC4716:        "SSH2 (RFC 4716)",
+	sshagent.ExportPKIX:           "PKIX PEM",
+	sshagent.ExportSHA256:         "SHA256 Fingerprint",
+	sshagent.ExportMD5:            "MD5 Fingerprint",
+	sshagent.ExportRandomArt:      "Randomart",
+	sshagent.ExportX509:           "X.509 Certificate",
+	sshagent.ExportThumbprint:     "X.509 Thumbprint",
+}
+
 type PubKeyView struct {
 	ag agent.Agent
 }
@@ -23,6 +37,13 @@ func (*PubKeyView) AppId() AppId {
 
 func (s *PubKeyView) Menu(register func(id AppId, name string, handler func())) {
 	register(s.AppId(), "Show Public Keys", s.onClick)
+	register(APP_PUBKEY_RESTORE, "Restore Hidden Keys", s.onRestoreClick)
+	for i, format := range sshagent.ExportFormats {
+		format := format
+		register(APP_PUBKEY_EXPORT+AppId(i), "Export Public Key"+SUBMENU_SEP+exportFormatNames[format], func() {
+			s.onExportClick(format)
+		})
+	}
 }
 
 func (s *PubKeyView) onClick() {
@@ -45,3 +66,85 @@ func (s *PubKeyView) onClick() {
 		utils.SetClipBoard(pubkey)
 	}
 }
+
+func (s *PubKeyView) onRestoreClick() {
+	hider, ok := s.ag.(sshagent.KeyHider)
+	if !ok {
+		utils.MessageBox("Error:", "No Hidden Keys", utils.MB_ICONWARNING)
+		return
+	}
+	keys := hider.HiddenKeys()
+	if len(keys) == 0 {
+		utils.MessageBox("Restore Hidden Keys:", "No Hidden Keys", utils.MB_ICONINFORMATION)
+		return
+	}
+	switch utils.MessageBox(
+		"Restore Hidden Keys:",
+		strings.Join(keys, "\n")+"\n\nYes restores all keys, No asks for each key.",
+		utils.MB_YESNOCANCEL,
+	) {
+	case utils.IDYES:
+		if err := hider.RestoreHiddenKeys(); err != nil {
+			utils.MessageBox("Error:", err.Error(), utils.MB_ICONWARNING)
+		}
+		return
+	case utils.IDNO:
+	default:
+		return
+	}
+
+	// lines end with the fingerprint
+	for _, key := range keys {
+		ret := utils.MessageBox("Restore Hidden Keys:", "Restore <"+key+">?", utils.MB_YESNOCANCEL)
+		if ret == utils.IDCANCEL {
+			return
+		}
+		if ret != utils.IDYES {
+			continue
+		}
+		if err := hider.RestoreHiddenKey(key[strings.LastIndex(key, " ")+1:]); err != nil {
+			utils.MessageBox("Error:", err.Error(), utils.MB_ICONWARNING)
+			return
+		}
+	}
+}
+
+func (s *PubKeyView) onExportClick(format string) {
+	keys, err := s.ag.List()
+	if err != nil {
+		utils.MessageBox("Error:", err.Error(), utils.MB_ICONWARNING)
+		return
+	}
+	if len(keys) == 0 {
+		utils.MessageBox("Error:", "No Keys", utils.MB_ICONWARNING)
+		return
+	}
+
+	// ask for each key until one is picked
+	for _, key := range keys {
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		ret := utils.MessageBox(
+			"Export Public Key:",
+			"Export <"+key.Comment+"> "+ssh.FingerprintSHA256(pub)+" as "+exportFormatNames[format]+"?",
+			utils.MB_YESNOCANCEL,
+		)
+		if ret == utils.IDNO {
+			continue
+		}
+		if ret != utils.IDYES {
+			return
+		}
+		text, err := sshagent.ExportPublicKey(s.ag, key, format, "")
+		if err != nil {
+			utils.MessageBox("Error:", err.Error(), utils.MB_ICONWARNING)
+			return
+		}
+		if utils.MessageBox(exportFormatNames[format]+" (OK to copy):", text, utils.MB_OKCANCEL) == utils.IDOK {
+			utils.SetClipBoard(text)
+		}
+		return
+	}
+}
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/capi"
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const DEFAULT_PUBKEY_NAME = "{comment}"
+
+// pubKeyManifest lists the files written to the directory, other files are never removed.
+const pubKeyManifest = ".wincrypt-pubkeys"
+
+// PubKeySync keeps one .pub file per key in a directory, for IdentityFile and IdentitiesOnly.
+type PubKeySync struct {
+	ag      agent.Agent
+	dir     string
+	name    string
+	running bool
+	mu      sync.Mutex
+	files   []string
+}
+
+func (s *PubKeySync) Run(ctx context.Context, handler func(conn io.ReadWriteCloser)) error {
+	s.ag = ctx.Value("agent").(agent.Agent)
+	s.dir, _ = ctx.Value("pubkey-dir").(string)
+	s.name, _ = ctx.Value("pubkey-name").(string)
+	if s.dir == "" {
+		return nil
+	}
+	if s.name == "" {
+		s.name = DEFAULT_PUBKEY_NAME
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	s.running = true
+
+	storeChanged := make(chan struct{}, 1)
+	if w, err := capi.WatchUserStore(); err == nil {
+		defer w.Close()
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				if changed, err := w.Wait(time.Second); err != nil {
+					return
+				} else if changed {
+					select {
+					case storeChanged <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	} else {
+		println("WatchUserStore error:", err.Error())
+	}
+
+	for {
+		if err := s.sync(); err != nil {
+			println("PubKeySync error:", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sshagent.KeysChanged():
+		case <-storeChanged:
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func pubKeyFileName(template string, key *agent.Key, pub ssh.PublicKey) string {
+	return safeFileName(strings.NewReplacer(
+		"{comment}", key.Comment,
+		"{fingerprint}", strings.TrimPrefix(ssh.FingerprintSHA256(pub), "SHA256:"),
+		"{type}", pub.Type(),
+	).Replace(template))
+}
+
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '-', r == '_', r == '@':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// pubKeyFile is a .pub file to write, name is without extension.
+type pubKeyFile struct {
+	name string
+	pub  ssh.PublicKey
+	data []byte
+}
+
+// uniqueNames adds a part of the fingerprint to names shared by several keys or already taken.
+// The key already stored in a shared file keeps its name, so names do not move between keys
+// when the order of the keys changes.
+func (s *PubKeySync) uniqueNames(files []*pubKeyFile, taken map[string][]byte) {
+	count := make(map[string]int)
+	for _, f := range files {
+		count[f.name]++
+	}
+	kept := make(map[string]bool)
+	for _, f := range files {
+		if _, ok := taken[f.name+".pub"]; !ok {
+			if count[f.name] == 1 {
+				continue
+			}
+			if !kept[f.name] {
+				if old, err := ioutil.ReadFile(filepath.Join(s.dir, f.name+".pub")); err == nil && bytes.Equal(old, f.data) {
+					kept[f.name] = true
+					continue
+				}
+			}
+		}
+		f.name += "-" + safeFileName(strings.TrimPrefix(ssh.FingerprintSHA256(f.pub), "SHA256:")[:8])
+	}
+}
+
+func (s *PubKeySync) sync() error {
+	// a locked agent lists no keys, the files stay for the IdentityFile settings using them
+	if locker, ok := s.ag.(interface{ Locked() bool }); ok && locker.Locked() {
+		return nil
+	}
+	keys, err := s.ag.List()
+	if err != nil {
+		return err
+	}
+	// nor are files removed for an empty list, e.g. of an agent locked in the meantime
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// plain keys first, so certificates can be named after their keys
+	names := make(map[string]string)
+	files := make(map[string][]byte)
+	seen := make(map[string]bool)
+	for _, certs := range []bool{false, true} {
+		var pass []*pubKeyFile
+		for _, key := range keys {
+			pub, err := ssh.ParsePublicKey(key.Blob)
+			if err != nil {
+				continue
+			}
+			cert, isCert := pub.(*ssh.Certificate)
+			if isCert != certs || seen[string(key.Blob)] {
+				continue
+			}
+			seen[string(key.Blob)] = true
+			var name string
+			if isCert {
+				name = names[string(cert.Key.Marshal())]
+				if name == "" {
+					name = pubKeyFileName(s.name, key, cert.Key)
+				}
+				name += "-cert"
+			} else {
+				name = pubKeyFileName(s.name, key, pub)
+			}
+			pass = append(pass, &pubKeyFile{name: name, pub: pub, data: []byte(key.String() + "\n")})
+		}
+		s.uniqueNames(pass, files)
+		for _, f := range pass {
+			if _, isCert := f.pub.(*ssh.Certificate); !isCert {
+				names[string(f.pub.Marshal())] = f.name
+			}
+			files[f.name+".pub"] = f.data
+		}
+	}
+
+	owned := s.loadManifest()
+	for file, data := range files {
+		path := filepath.Join(s.dir, file)
+		if old, err := ioutil.ReadFile(path); err == nil {
+			if bytes.Equal(old, data) {
+				continue
+			}
+			// a file of the user with the same name is kept
+			if !owned[file] {
+				println("PubKeySync: not overwriting", path)
+				delete(files, file)
+				continue
+			}
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		owned[file] = true
+	}
+
+	// only files written by the agent are removed when their keys are gone
+	for file := range owned {
+		if _, ok := files[file]; !ok {
+			if err := os.Remove(filepath.Join(s.dir, file)); err == nil || os.IsNotExist(err) {
+				delete(owned, file)
+			}
+		}
+	}
+	if err := s.saveManifest(owned); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.files = s.files[:0]
+	for file := range files {
+		if !strings.HasSuffix(file, "-cert.pub") {
+			s.files = append(s.files, file)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *PubKeySync) loadManifest() map[string]bool {
+	owned := make(map[string]bool)
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, pubKeyManifest))
+	if err != nil {
+		return owned
+	}
+	for _, file := range strings.Split(string(data), "\n") {
+		if file = strings.TrimSpace(file); file != "" && file == filepath.Base(file) {
+			owned[file] = true
+		}
+	}
+	return owned
+}
+
+func (s *PubKeySync) saveManifest(owned map[string]bool) error {
+	var data bytes.Buffer
+	for file := range owned {
+		data.WriteString(file + "\r\n")
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, pubKeyManifest), data.Bytes(), 0644)
+}
+
+func (*PubKeySync) AppId() AppId {
+	return APP_PUBKEY_SYNC
+}
+
+func (s *PubKeySync) Menu(register func(id AppId, name string, handler func())) {
+	register(s.AppId(), "Show IdentityFile Settings", s.onClick)
+}
+
+func (s *PubKeySync) onClick() {
+	if !s.running {
+		utils.MessageBox("Error:", "Public key files are disabled, start the agent with -pubkey-dir", utils.MB_ICONWARNING)
+		return
+	}
+
+	s.mu.Lock()
+	help := "Host example.com\n"
+	for _, file := range s.files {
+		help += "    IdentityFile \"" + filepath.Join(s.dir, file) + "\"\n"
+	}
+	help += "    IdentitiesOnly yes"
+	s.mu.Unlock()
+	if utils.MessageBox(s.AppId().FullName()+" (OK to copy):", help, utils.MB_OKCANCEL) == utils.IDOK {
+		utils.SetClipBoard(help)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"io"
 	"net"
 	"sync"
-	"time"
 
 	"github.com/Microsoft/go-winio"
 	"github.com/Microsoft/go-winio/pkg/guid"
@@ -64,69 +63,37 @@ func (s *vSockWorker) Close() {
 	s.l.Close()
 }
 
-func vmidDiff(old, new []string) (add, del []string) {
-	add = make([]string, 0)
-	del = make([]string, 0)
-	oldIDS := make(map[string]interface{})
-	newIDS := make(map[string]interface{})
-	for _, v := range old {
-		oldIDS[v] = 0
-	}
-	for _, v := range new {
-		newIDS[v] = 0
-	}
-	for _, v := range new {
-		if _, ok := oldIDS[v]; !ok {
-			add = append(add, v)
-		}
-	}
-	for _, v := range old {
-		if _, ok := newIDS[v]; !ok {
-			del = append(del, v)
-		}
-	}
-	return
-}
-
-func (s *VSock) wsl2Watcher(ctx context.Context, handler func(conn io.ReadWriteCloser)) {
-	timeout := time.Second * 60
-	ch := make(chan *utils.ProcessEvent, 1)
-	pn, err := utils.NewProcessNotify("wslhost.exe", ch)
-	if err != nil {
-		// fallback to polling mode
-		timeout = time.Second * 15
-		println("ProcessNotify error:", err.Error())
-	} else {
-		pn.Start()
-		defer pn.Stop()
-	}
-	lastVMIDs := make([]string, 0)
+// vmWatcher listens on the Hyper-V socket of each utility VM, e.g. WSL2, which the wildcard listener does not cover.
+func (s *VSock) vmWatcher(ctx context.Context, handler func(conn io.ReadWriteCloser)) {
+	events := make(chan utils.VMEvent)
+	go utils.WatchVMs(ctx.Done(), events)
 	workers := make(map[string]*vSockWorker)
+	defer func() {
+		for _, w := range workers {
+			w.Close()
+		}
+	}()
 	for {
-		vmids := utils.GetVMIDs()
-		add, del := vmidDiff(lastVMIDs, vmids)
-		for _, v := range add {
-			w, err := newVSockWorker(v, handler)
-			if err != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			if !ev.VM.Utility {
 				continue
 			}
-			workers[v] = w
-			go w.Run()
-		}
-		for _, v := range del {
-			w := workers[v]
-			if w != nil {
+			if ev.Running {
+				w, err := newVSockWorker(ev.VM.ID, handler)
+				if err != nil {
+					println("vsock error:", ev.VM.Name, err.Error())
+					continue
+				}
+				workers[ev.VM.ID] = w
+				go w.Run()
+			} else if w := workers[ev.VM.ID]; w != nil {
 				w.Close()
-				delete(workers, v)
+				delete(workers, ev.VM.ID)
 			}
 		}
-		lastVMIDs = vmids
-		select {
-		case <-ctx.Done():
-			return
-		case <-ch:
-		case <-time.After(timeout):
-		}
 	}
 }
 
@@ -155,7 +122,7 @@ func (s *VSock) Run(ctx context.Context, handler func(conn io.ReadWriteCloser))
 	s.running = true
 	defer pipe.Close()
 
-	go s.wsl2Watcher(ctx, handler)
+	go s.vmWatcher(ctx, handler)
 
 	wg := new(sync.WaitGroup)
 	// context cancelled
@@ -196,9 +163,11 @@ func (s *VSock) onClick() {
 		return
 	}
 
-	// socat 1.7.4 support vsock,
-	// `SOCKET-CONNECT` can be replaced with `VSOCK-CONNECT:2:0x22223333`
-	help := `export SSH_AUTH_SOCK=/tmp/wincrypt-hv.sock
+	// wincrypt-bridge is shipped with the release, socat 1.7.4 also supports vsock
+	help := `eval $(wincrypt-bridge -s)
+
+# or without wincrypt-bridge:
+export SSH_AUTH_SOCK=/tmp/wincrypt-hv.sock
 ss -lnx | grep -q $SSH_AUTH_SOCK
 if [ $? -ne 0 ]; then
 	rm -f $SSH_AUTH_SOCK
@@ -1,14 +1,19 @@
 @echo off
 setlocal
 
+@rem PKCS #11 support needs cgo, so a C compiler is needed for each architecture,
+@rem CI uses llvm-mingw, set CC_386, CC_AMD64 or CC_ARM64 for another one
+if not defined CC_386 set CC_386=i686-w64-mingw32-clang
+if not defined CC_AMD64 set CC_AMD64=x86_64-w64-mingw32-clang
+if not defined CC_ARM64 set CC_ARM64=aarch64-w64-mingw32-clang
+
 @rem Build all by default
 if [%1]==[] (
-	go generate
-	call :build 386 WinCryptSSHAgent_32bit.exe
-	call :build amd64 WinCryptSSHAgent.exe
+	call :build 386 WinCryptSSHAgent_32bit.exe || exit /b 1
+	call :build amd64 WinCryptSSHAgent.exe || exit /b 1
+	call :bridge amd64 wincrypt-bridge || exit /b 1
 ) else (
-	go generate
-	call :build %1 WinCryptSSHAgent-%1.exe
+	call :build %1 WinCryptSSHAgent-%1.exe || exit /b 1
 )
 goto :eof
 
@@ -18,7 +23,29 @@ set arch=%1
 set output=%2
 echo Build %arch% to %output%
 
+@rem cgo links externally, so the version resource must be of the same architecture
+set resflags=
+if [%arch%]==[amd64] set resflags=-64
+if [%arch%]==[arm64] set resflags=-64 -arm
+goversioninfo %resflags% -icon=assets/icon.ico || exit /b 1
+
+set GOARCH=%arch%
+set CGO_ENABLED=1
+call set CC=%%CC_%arch%%%
+go build -ldflags "-w -s -H=windowsgui" -trimpath -o %output% || exit /b 1
+
+goto :eof
+
+
+:bridge
+set arch=%1
+set output=%2
+echo Build linux/%arch% to %output%
+
+set GOOS=linux
 set GOARCH=%arch%
-go build -ldflags "-w -s -H=windowsgui" -trimpath -o %output%
+set CGO_ENABLED=0
+go build -ldflags "-w -s" -trimpath -o %output% ./cmd/wincrypt-bridge || exit /b 1
+set GOOS=
 
 goto :eof
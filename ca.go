@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	caKey        = flag.String("ca-key", "", "CA mode: common name, serial number or SHA256 fingerprint of the CA key")
+	caSign       = flag.String("ca-sign", "", "CA mode: OpenSSH public key file to sign")
+	caID         = flag.String("ca-id", "", "CA mode: certificate key id")
+	caPrincipals = flag.String("ca-principals", "", "CA mode: comma separated list of principals")
+	caValidity   = flag.Duration("ca-validity", time.Hour*24, "CA mode: certificate validity period")
+	caHost       = flag.Bool("ca-host", false, "CA mode: issue a host certificate")
+	caExport     = flag.String("ca-export", "", "CA mode: directory to write new authorized_keys and TrustedUserCAKeys files to, existing files are not overwritten")
+
+	caOptions    stringList
+	caExtensions stringList
+)
+
+func runCA() {
+	msg, err := certAuthority()
+	if err != nil {
+		utils.MessageBox("CA Error:", err.Error(), utils.MB_ICONERROR)
+		return
+	}
+	if utils.MessageBox("CA (OK to copy):", msg, utils.MB_OKCANCEL) == utils.IDOK {
+		utils.SetClipBoard(msg)
+	}
+}
+
+func certAuthority() (string, error) {
+	cag := new(sshagent.CAPIAgent)
+	defer cag.Close()
+	ca, err := sshagent.NewCertAuthority(cag, *caKey)
+	if err != nil {
+		return "", err
+	}
+	principals := splitList(*caPrincipals)
+
+	if *caSign == "" && *caExport == "" {
+		return "", errors.New("ca: nothing to do, use -ca-sign or -ca-export")
+	}
+
+	var msg string
+	if *caExport != "" {
+		err = writeNewFile(filepath.Join(*caExport, "authorized_keys"), []byte(ca.AuthorizedKeysLine(principals)+"\n"))
+		if err != nil {
+			return "", err
+		}
+		err = writeNewFile(filepath.Join(*caExport, "TrustedUserCAKeys"), []byte(ca.TrustedUserCAKeys()+"\n"))
+		if err != nil {
+			return "", err
+		}
+		msg += ca.AuthorizedKeysLine(principals) + "\n"
+	}
+
+	if *caSign != "" {
+		data, err := ioutil.ReadFile(*caSign)
+		if err != nil {
+			return "", err
+		}
+		pub, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return "", err
+		}
+		req := &sshagent.CertRequest{
+			PublicKey:       pub,
+			KeyId:           *caID,
+			CertType:        ssh.UserCert,
+			Principals:      principals,
+			ValidAfter:      time.Now().Add(-time.Minute),
+			ValidBefore:     time.Now().Add(*caValidity),
+			CriticalOptions: sshagent.ParseCertOptions(caOptions),
+			Extensions:      sshagent.ParseCertOptions(caExtensions),
+		}
+		if req.KeyId == "" {
+			req.KeyId = comment
+		}
+		if *caHost {
+			req.CertType = ssh.HostCert
+		} else if len(caExtensions) == 0 {
+			req.Extensions = sshagent.DefaultUserExtensions
+		}
+		cert, err := ca.Issue(req)
+		if err != nil {
+			return "", err
+		}
+		path, err := sshagent.WriteCertificate(*caSign, cert)
+		if err != nil {
+			return "", err
+		}
+		msg += "Certificate written to " + path + "\n"
+	}
+	return msg, nil
+}
+
+// writeNewFile writes a file which must not exist yet, e.g. an authorized_keys in use stays untouched.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return errors.New("ca: " + path + " exists, it is not overwritten")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,77 @@
+package capi
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	PKCS12_NO_PERSIST_KEY  = uint32(0x00008000)
+	PKCS12_ALWAYS_CNG_KSP  = uint32(0x00000200)
+	CRYPT_USER_KEYSET      = uint32(0x00001000)
+	ERROR_INVALID_PASSWORD = syscall.Errno(86)
+)
+
+var procPFXImportCertStore = modcrypt32.NewProc("PFXImportCertStore")
+
+// CertStore is an opened system store or the in-memory store of a PFX file.
+type CertStore struct {
+	handle syscall.Handle
+}
+
+// OpenSystemStore opens a store like CurrentUser\My or LocalMachine\My read-only.
+func OpenSystemStore(location, name string) (*CertStore, error) {
+	var flags uint32
+	switch strings.ToLower(location) {
+	case "currentuser", "":
+		flags = CERT_SYSTEM_STORE_CURRENT_USER
+	case "localmachine":
+		flags = CERT_SYSTEM_STORE_LOCAL_MACHINE
+	default:
+		return nil, fmt.Errorf("capi: unknown store location %s", location)
+	}
+	handle, err := openSystemStore(flags, name, CERT_STORE_READONLY_FLAG)
+	if err != nil {
+		return nil, err
+	}
+	return &CertStore{handle: handle}, nil
+}
+
+// OpenPFX imports a PKCS #12 file into memory, the keys are not persisted. A wrong password
+// returns ERROR_INVALID_PASSWORD.
+func OpenPFX(data []byte, password string) (*CertStore, error) {
+	if len(data) == 0 {
+		return nil, errors.New("capi: empty PFX file")
+	}
+	passwordPtr, err := syscall.UTF16PtrFromString(password)
+	if err != nil {
+		return nil, err
+	}
+	blob := cryptoapiBlob{
+		DataSize: uint32(len(data)),
+		Data:     uintptr(unsafe.Pointer(&data[0])),
+	}
+	r0, _, e1 := syscall.Syscall(procPFXImportCertStore.Addr(), 3,
+		uintptr(unsafe.Pointer(&blob)),
+		uintptr(unsafe.Pointer(passwordPtr)),
+		uintptr(PKCS12_NO_PERSIST_KEY|PKCS12_ALWAYS_CNG_KSP|CRYPT_USER_KEYSET),
+	)
+	runtime.KeepAlive(data)
+	if r0 == 0 {
+		return nil, e1
+	}
+	return &CertStore{handle: syscall.Handle(r0)}, nil
+}
+
+// Certificates returns the certificates with a private key, they must be freed by the caller.
+func (s *CertStore) Certificates() ([]*Certificate, error) {
+	return loadCerts(s.handle)
+}
+
+func (s *CertStore) Close() error {
+	return syscall.CertCloseStore(s.handle, 0)
+}
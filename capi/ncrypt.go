@@ -0,0 +1,631 @@
+package capi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	MS_KEY_STORAGE_PROVIDER            = "Microsoft Software Key Storage Provider"
+	MS_SMART_CARD_KEY_STORAGE_PROVIDER = "Microsoft Smart Card Key Storage Provider"
+	MS_PLATFORM_CRYPTO_PROVIDER        = "Microsoft Platform Crypto Provider"
+
+	NCRYPT_EXPORT_POLICY_PROPERTY = "Export Policy"
+	NCRYPT_LENGTH_PROPERTY        = "Length"
+
+	NCRYPT_RSA_ALGORITHM        = "RSA"
+	NCRYPT_ECDSA_P256_ALGORITHM = "ECDSA_P256"
+	NCRYPT_ECDSA_P384_ALGORITHM = "ECDSA_P384"
+	NCRYPT_ECDSA_P521_ALGORITHM = "ECDSA_P521"
+)
+
+const (
+	NCRYPT_OVERWRITE_KEY_FLAG   = uint32(0x00000080)
+	NCRYPT_DO_NOT_FINALIZE_FLAG = uint32(0x00000400)
+	NCRYPT_PERSIST_FLAG         = uint32(0x80000000)
+	NCRYPTBUFFER_PKCS_KEY_NAME  = uint32(45)
+	BCRYPT_PAD_PKCS1            = uint32(0x00000002)
+
+	BCRYPT_RSAPUBLIC_MAGIC          = uint32(0x31415352)
+	BCRYPT_RSAPRIVATE_MAGIC         = uint32(0x32415352)
+	BCRYPT_ECDSA_PUBLIC_P256        = uint32(0x31534345)
+	BCRYPT_ECDSA_PUBLIC_P384        = uint32(0x33534345)
+	BCRYPT_ECDSA_PUBLIC_P521        = uint32(0x35534345)
+	BCRYPT_ECDSA_PRIVATE_P256       = uint32(0x32534345)
+	BCRYPT_ECDSA_PRIVATE_P384       = uint32(0x34534345)
+	BCRYPT_ECDSA_PRIVATE_P521       = uint32(0x36534345)
+	CERT_KEY_PROV_INFO_PROP_ID      = uint32(2)
+	CERT_STORE_ADD_REPLACE_EXISTING = uint32(3)
+)
+
+var (
+	procNCryptOpenStorageProvider = modncrypt.NewProc("NCryptOpenStorageProvider")
+	procNCryptImportKey           = modncrypt.NewProc("NCryptImportKey")
+	procNCryptCreatePersistedKey  = modncrypt.NewProc("NCryptCreatePersistedKey")
+	procNCryptExportKey           = modncrypt.NewProc("NCryptExportKey")
+	procNCryptFinalizeKey         = modncrypt.NewProc("NCryptFinalizeKey")
+	procNCryptSignHash            = modncrypt.NewProc("NCryptSignHash")
+	procNCryptFreeObject          = modncrypt.NewProc("NCryptFreeObject")
+	procNCryptDeleteKey           = modncrypt.NewProc("NCryptDeleteKey")
+	procNCryptEnumKeys            = modncrypt.NewProc("NCryptEnumKeys")
+	procNCryptOpenKey             = modncrypt.NewProc("NCryptOpenKey")
+	procNCryptFreeBuffer          = modncrypt.NewProc("NCryptFreeBuffer")
+
+	procCertAddEncodedCertificateToStore  = modcrypt32.NewProc("CertAddEncodedCertificateToStore")
+	procCertSetCertificateContextProperty = modcrypt32.NewProc("CertSetCertificateContextProperty")
+)
+
+type nCryptBuffer struct {
+	CbBuffer   uint32
+	BufferType uint32
+	PvBuffer   uintptr
+}
+
+type nCryptBufferDesc struct {
+	Version uint32
+	Buffers uint32
+	Buffer  uintptr
+}
+
+type nCryptKeyName struct {
+	Name          *uint16
+	Algid         *uint16
+	LegacyKeySpec uint32
+	Flags         uint32
+}
+
+type bCryptPKCS1PaddingInfo struct {
+	AlgId uintptr
+}
+
+type cryptKeyProvInfo struct {
+	ContainerName uintptr
+	ProvName      uintptr
+	ProvType      uint32
+	Flags         uint32
+	ProvParamSize uint32
+	ProvParam     uintptr
+	KeySpec       uint32
+}
+
+func securityStatus(r0 uintptr) error {
+	if r0 != 0 {
+		return syscall.Errno(r0)
+	}
+	return nil
+}
+
+func nCryptFreeObject(handle uintptr) error {
+	r0, _, _ := syscall.Syscall(procNCryptFreeObject.Addr(), 1, handle, 0, 0)
+	return securityStatus(r0)
+}
+
+// KeyStorageProvider is an opened CNG key storage provider.
+type KeyStorageProvider struct {
+	handle uintptr
+	Name   string
+}
+
+func OpenKeyStorageProvider(name string) (*KeyStorageProvider, error) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	var handle uintptr
+	r0, _, _ := syscall.Syscall(procNCryptOpenStorageProvider.Addr(), 3,
+		uintptr(unsafe.Pointer(&handle)),
+		uintptr(unsafe.Pointer(namePtr)),
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptOpenStorageProvider: %v", err)
+	}
+	return &KeyStorageProvider{handle: handle, Name: name}, nil
+}
+
+func (p *KeyStorageProvider) Close() error {
+	return nCryptFreeObject(p.handle)
+}
+
+// KeyName is a persisted key in a key storage provider.
+type KeyName struct {
+	Name          string
+	Algorithm     string
+	LegacyKeySpec uint32
+}
+
+// Keys lists the persisted keys of the current user.
+func (p *KeyStorageProvider) Keys() ([]KeyName, error) {
+	const NTE_NO_MORE_ITEMS = 0x8009002A
+	var state uintptr
+	defer func() {
+		if state != 0 {
+			syscall.Syscall(procNCryptFreeBuffer.Addr(), 1, state, 0, 0)
+		}
+	}()
+	keys := make([]KeyName, 0)
+	for {
+		var name *nCryptKeyName
+		r0, _, _ := syscall.Syscall6(procNCryptEnumKeys.Addr(), 5,
+			p.handle,
+			0,
+			uintptr(unsafe.Pointer(&name)),
+			uintptr(unsafe.Pointer(&state)),
+			0,
+			0,
+		)
+		if r0 == NTE_NO_MORE_ITEMS {
+			return keys, nil
+		}
+		if err := securityStatus(r0); err != nil {
+			return nil, fmt.Errorf("NCryptEnumKeys: %v", err)
+		}
+		keys = append(keys, KeyName{
+			Name:          utf16PtrToString(name.Name),
+			Algorithm:     utf16PtrToString(name.Algid),
+			LegacyKeySpec: name.LegacyKeySpec,
+		})
+		syscall.Syscall(procNCryptFreeBuffer.Addr(), 1, uintptr(unsafe.Pointer(name)), 0, 0)
+	}
+}
+
+// OpenKey opens a persisted key and reads its public key.
+func (p *KeyStorageProvider) OpenKey(key KeyName) (*NCryptKey, error) {
+	namePtr, err := syscall.UTF16PtrFromString(key.Name)
+	if err != nil {
+		return nil, err
+	}
+	var handle uintptr
+	r0, _, _ := syscall.Syscall6(procNCryptOpenKey.Addr(), 5,
+		p.handle,
+		uintptr(unsafe.Pointer(&handle)),
+		uintptr(unsafe.Pointer(namePtr)),
+		uintptr(key.LegacyKeySpec),
+		0,
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptOpenKey: %v", err)
+	}
+	k := &NCryptKey{handle: handle, Name: key.Name, Provider: p.Name}
+	if k.public, err = k.exportPublicKey(); err != nil {
+		k.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	s := make([]uint16, 0)
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(s)
+}
+
+// ImportKey persists an RSA or ECDSA private key under name, it cannot be exported again unless exportable is set.
+func (p *KeyStorageProvider) ImportKey(name string, priv crypto.Signer, exportable bool) (*NCryptKey, error) {
+	blobType, blob, err := privateKeyBlob(priv)
+	if err != nil {
+		return nil, err
+	}
+	blobTypePtr, _ := syscall.UTF16PtrFromString(blobType)
+	nameUTF16, err := syscall.UTF16FromString(name)
+	if err != nil {
+		return nil, err
+	}
+	buffer := nCryptBuffer{
+		CbBuffer:   uint32(len(nameUTF16) * 2),
+		BufferType: NCRYPTBUFFER_PKCS_KEY_NAME,
+		PvBuffer:   uintptr(unsafe.Pointer(&nameUTF16[0])),
+	}
+	params := nCryptBufferDesc{
+		Buffers: 1,
+		Buffer:  uintptr(unsafe.Pointer(&buffer)),
+	}
+
+	var handle uintptr
+	r0, _, _ := syscall.Syscall9(procNCryptImportKey.Addr(), 8,
+		p.handle,
+		0,
+		uintptr(unsafe.Pointer(blobTypePtr)),
+		uintptr(unsafe.Pointer(&params)),
+		uintptr(unsafe.Pointer(&handle)),
+		uintptr(unsafe.Pointer(&blob[0])),
+		uintptr(len(blob)),
+		uintptr(NCRYPT_DO_NOT_FINALIZE_FLAG|NCRYPT_OVERWRITE_KEY_FLAG),
+		0,
+	)
+	// the blob holds the private key in the clear
+	for i := range blob {
+		blob[i] = 0
+	}
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptImportKey: %v", err)
+	}
+	key := &NCryptKey{handle: handle, Name: name, Provider: p.Name, public: priv.Public()}
+
+	policy := uint32(0)
+	if exportable {
+		policy = 0x1 // NCRYPT_ALLOW_EXPORT_FLAG
+	}
+	if err := key.setProperty(NCRYPT_EXPORT_POLICY_PROPERTY, (*[4]byte)(unsafe.Pointer(&policy))[:], NCRYPT_PERSIST_FLAG); err != nil {
+		key.Close()
+		return nil, fmt.Errorf("NCryptSetProperty: %v", err)
+	}
+	r0, _, _ = syscall.Syscall(procNCryptFinalizeKey.Addr(), 2, handle, 0, 0)
+	if err := securityStatus(r0); err != nil {
+		key.Close()
+		return nil, fmt.Errorf("NCryptFinalizeKey: %v", err)
+	}
+	return key, nil
+}
+
+// CreateKey generates a persisted key named name, algorithm is one of the NCRYPT_*_ALGORITHM constants
+// and bits is only used for RSA.
+func (p *KeyStorageProvider) CreateKey(name string, algorithm string, bits int) (*NCryptKey, error) {
+	algorithmPtr, _ := syscall.UTF16PtrFromString(algorithm)
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	var handle uintptr
+	r0, _, _ := syscall.Syscall6(procNCryptCreatePersistedKey.Addr(), 6,
+		p.handle,
+		uintptr(unsafe.Pointer(&handle)),
+		uintptr(unsafe.Pointer(algorithmPtr)),
+		uintptr(unsafe.Pointer(namePtr)),
+		0,
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptCreatePersistedKey: %v", err)
+	}
+	key := &NCryptKey{handle: handle, Name: name, Provider: p.Name}
+	if algorithm == NCRYPT_RSA_ALGORITHM && bits > 0 {
+		length := uint32(bits)
+		if err := key.setProperty(NCRYPT_LENGTH_PROPERTY, (*[4]byte)(unsafe.Pointer(&length))[:], 0); err != nil {
+			key.Close()
+			return nil, fmt.Errorf("NCryptSetProperty: %v", err)
+		}
+	}
+	r0, _, _ = syscall.Syscall(procNCryptFinalizeKey.Addr(), 2, handle, 0, 0)
+	if err := securityStatus(r0); err != nil {
+		key.Close()
+		return nil, fmt.Errorf("NCryptFinalizeKey: %v", err)
+	}
+	if key.public, err = key.exportPublicKey(); err != nil {
+		key.Delete()
+		return nil, err
+	}
+	return key, nil
+}
+
+// NCryptKey is a handle of a persisted CNG key, it signs with NCryptSignHash.
+type NCryptKey struct {
+	handle   uintptr
+	public   crypto.PublicKey
+	Name     string
+	Provider string
+}
+
+func (k *NCryptKey) Close() error {
+	if k.handle == 0 {
+		return nil
+	}
+	return nCryptFreeObject(k.handle)
+}
+
+// Delete removes the persisted key from its key storage provider and frees the handle.
+func (k *NCryptKey) Delete() error {
+	if k.handle == 0 {
+		return nil
+	}
+	r0, _, _ := syscall.Syscall(procNCryptDeleteKey.Addr(), 2, k.handle, 0, 0)
+	if err := securityStatus(r0); err != nil {
+		return fmt.Errorf("NCryptDeleteKey: %v", err)
+	}
+	k.handle = 0
+	return nil
+}
+
+func (k *NCryptKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+func (k *NCryptKey) setProperty(property string, value []byte, flags uint32) error {
+	propertyPtr, _ := syscall.UTF16PtrFromString(property)
+	r0, _, _ := syscall.Syscall6(procNCryptSetProperty.Addr(), 5,
+		k.handle,
+		uintptr(unsafe.Pointer(propertyPtr)),
+		uintptr(unsafe.Pointer(&value[0])),
+		uintptr(len(value)),
+		uintptr(flags),
+		0,
+	)
+	return securityStatus(r0)
+}
+
+func (k *NCryptKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("ncrypt: RSA-PSS is not supported")
+	}
+	sig, err := k.SignHash(digest, opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := k.public.(*ecdsa.PublicKey); ok {
+		// crypto.Signer callers expect ASN.1
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// SignHash signs a digest, RSA keys use PKCS #1 v1.5 padding and ECDSA signatures are returned as r || s.
+func (k *NCryptKey) SignHash(digest []byte, hash crypto.Hash) ([]byte, error) {
+	var padding *bCryptPKCS1PaddingInfo
+	var algPtr *uint16
+	var flags uint32
+	switch k.public.(type) {
+	case *rsa.PublicKey:
+		var alg string
+		switch hash {
+		case crypto.SHA1:
+			alg = "SHA1"
+		case crypto.SHA256:
+			alg = "SHA256"
+		case crypto.SHA384:
+			alg = "SHA384"
+		case crypto.SHA512:
+			alg = "SHA512"
+		default:
+			return nil, errors.New("ncrypt: unsupported hash function")
+		}
+		algPtr, _ = syscall.UTF16PtrFromString(alg)
+		padding = &bCryptPKCS1PaddingInfo{AlgId: uintptr(unsafe.Pointer(algPtr))}
+		flags = BCRYPT_PAD_PKCS1
+	case *ecdsa.PublicKey:
+	default:
+		return nil, errors.New("ncrypt: unsupported key type")
+	}
+
+	var size uint32
+	r0, _, _ := syscall.Syscall9(procNCryptSignHash.Addr(), 8,
+		k.handle,
+		uintptr(unsafe.Pointer(padding)),
+		uintptr(unsafe.Pointer(&digest[0])),
+		uintptr(len(digest)),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&size)),
+		uintptr(flags),
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptSignHash: %v", err)
+	}
+	sig := make([]byte, size)
+	r0, _, _ = syscall.Syscall9(procNCryptSignHash.Addr(), 8,
+		k.handle,
+		uintptr(unsafe.Pointer(padding)),
+		uintptr(unsafe.Pointer(&digest[0])),
+		uintptr(len(digest)),
+		uintptr(unsafe.Pointer(&sig[0])),
+		uintptr(len(sig)),
+		uintptr(unsafe.Pointer(&size)),
+		uintptr(flags),
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptSignHash: %v", err)
+	}
+	runtime.KeepAlive(algPtr)
+	return sig[:size], nil
+}
+
+func (k *NCryptKey) exportBlob(blobType string) ([]byte, error) {
+	blobTypePtr, _ := syscall.UTF16PtrFromString(blobType)
+	var size uint32
+	r0, _, _ := syscall.Syscall9(procNCryptExportKey.Addr(), 8,
+		k.handle,
+		0,
+		uintptr(unsafe.Pointer(blobTypePtr)),
+		0,
+		0,
+		0,
+		uintptr(unsafe.Pointer(&size)),
+		0,
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptExportKey: %v", err)
+	}
+	blob := make([]byte, size)
+	r0, _, _ = syscall.Syscall9(procNCryptExportKey.Addr(), 8,
+		k.handle,
+		0,
+		uintptr(unsafe.Pointer(blobTypePtr)),
+		0,
+		uintptr(unsafe.Pointer(&blob[0])),
+		uintptr(len(blob)),
+		uintptr(unsafe.Pointer(&size)),
+		0,
+		0,
+	)
+	if err := securityStatus(r0); err != nil {
+		return nil, fmt.Errorf("NCryptExportKey: %v", err)
+	}
+	return blob[:size], nil
+}
+
+// exportPublicKey reads the public key, which can be exported from non-exportable keys too.
+func (k *NCryptKey) exportPublicKey() (crypto.PublicKey, error) {
+	if blob, err := k.exportBlob("RSAPUBLICBLOB"); err == nil {
+		return parsePublicKeyBlob(blob)
+	}
+	blob, err := k.exportBlob("ECCPUBLICBLOB")
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKeyBlob(blob)
+}
+
+// parsePublicKeyBlob decodes a BCRYPT_RSAPUBLIC_BLOB or BCRYPT_ECCPUBLIC_BLOB.
+func parsePublicKeyBlob(blob []byte) (crypto.PublicKey, error) {
+	if len(blob) < 8 {
+		return nil, errors.New("ncrypt: invalid public key blob")
+	}
+	magic := binary.LittleEndian.Uint32(blob)
+	switch magic {
+	case BCRYPT_RSAPUBLIC_MAGIC:
+		if len(blob) < 24 {
+			return nil, errors.New("ncrypt: invalid public key blob")
+		}
+		expSize := int(binary.LittleEndian.Uint32(blob[8:]))
+		modulusSize := int(binary.LittleEndian.Uint32(blob[12:]))
+		if len(blob) < 24+expSize+modulusSize || expSize > 4 {
+			return nil, errors.New("ncrypt: invalid public key blob")
+		}
+		exp := new(big.Int).SetBytes(blob[24 : 24+expSize])
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(blob[24+expSize : 24+expSize+modulusSize]),
+			E: int(exp.Int64()),
+		}, nil
+	case BCRYPT_ECDSA_PUBLIC_P256, BCRYPT_ECDSA_PUBLIC_P384, BCRYPT_ECDSA_PUBLIC_P521:
+		var curve elliptic.Curve
+		switch magic {
+		case BCRYPT_ECDSA_PUBLIC_P256:
+			curve = elliptic.P256()
+		case BCRYPT_ECDSA_PUBLIC_P384:
+			curve = elliptic.P384()
+		default:
+			curve = elliptic.P521()
+		}
+		size := int(binary.LittleEndian.Uint32(blob[4:]))
+		if len(blob) < 8+2*size {
+			return nil, errors.New("ncrypt: invalid public key blob")
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(blob[8 : 8+size]),
+			Y:     new(big.Int).SetBytes(blob[8+size : 8+2*size]),
+		}, nil
+	}
+	return nil, errors.New("ncrypt: unsupported public key blob")
+}
+
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// privateKeyBlob encodes priv as a BCRYPT_RSAPRIVATE_BLOB or BCRYPT_ECCPRIVATE_BLOB.
+func privateKeyBlob(priv crypto.Signer) (string, []byte, error) {
+	var header []uint32
+	var parts [][]byte
+	var blobType string
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return "", nil, errors.New("ncrypt: multi-prime RSA keys are not supported")
+		}
+		bits := k.N.BitLen()
+		exp := big.NewInt(int64(k.E)).Bytes()
+		modulus := paddedBytes(k.N, (bits+7)/8)
+		prime1 := paddedBytes(k.Primes[0], (bits+15)/16)
+		prime2 := paddedBytes(k.Primes[1], (bits+15)/16)
+		blobType = "RSAPRIVATEBLOB"
+		header = []uint32{BCRYPT_RSAPRIVATE_MAGIC, uint32(bits), uint32(len(exp)), uint32(len(modulus)), uint32(len(prime1)), uint32(len(prime2))}
+		parts = [][]byte{exp, modulus, prime1, prime2}
+	case *ecdsa.PrivateKey:
+		var magic uint32
+		switch k.Curve {
+		case elliptic.P256():
+			magic = BCRYPT_ECDSA_PRIVATE_P256
+		case elliptic.P384():
+			magic = BCRYPT_ECDSA_PRIVATE_P384
+		case elliptic.P521():
+			magic = BCRYPT_ECDSA_PRIVATE_P521
+		default:
+			return "", nil, errors.New("ncrypt: unsupported curve")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		blobType = "ECCPRIVATEBLOB"
+		header = []uint32{magic, uint32(size)}
+		parts = [][]byte{paddedBytes(k.X, size), paddedBytes(k.Y, size), paddedBytes(k.D, size)}
+	default:
+		return "", nil, errors.New("ncrypt: unsupported key type")
+	}
+
+	blob := make([]byte, 4*len(header))
+	for i, v := range header {
+		binary.LittleEndian.PutUint32(blob[4*i:], v)
+	}
+	for _, part := range parts {
+		blob = append(blob, part...)
+	}
+	return blobType, blob, nil
+}
+
+// AddUserCertificate stores a DER certificate in the user's My store and links it to the CNG key.
+func AddUserCertificate(der []byte, key *NCryptKey) error {
+	store, err := openSystemStore(CERT_SYSTEM_STORE_CURRENT_USER, "My", 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CertCloseStore(store, 0)
+
+	var context *syscall.CertContext
+	r0, _, e1 := syscall.Syscall6(procCertAddEncodedCertificateToStore.Addr(), 6,
+		uintptr(store),
+		X509_ASN_ENCODING|PKCS_7_ASN_ENCODING,
+		uintptr(unsafe.Pointer(&der[0])),
+		uintptr(len(der)),
+		uintptr(CERT_STORE_ADD_REPLACE_EXISTING),
+		uintptr(unsafe.Pointer(&context)),
+	)
+	if r0 == 0 {
+		return fmt.Errorf("CertAddEncodedCertificateToStore: %v", e1)
+	}
+	defer syscall.CertFreeCertificateContext(context)
+
+	containerPtr, _ := syscall.UTF16PtrFromString(key.Name)
+	providerPtr, _ := syscall.UTF16PtrFromString(key.Provider)
+	info := cryptKeyProvInfo{
+		ContainerName: uintptr(unsafe.Pointer(containerPtr)),
+		ProvName:      uintptr(unsafe.Pointer(providerPtr)),
+	}
+	r0, _, e1 = syscall.Syscall6(procCertSetCertificateContextProperty.Addr(), 4,
+		uintptr(unsafe.Pointer(context)),
+		uintptr(CERT_KEY_PROV_INFO_PROP_ID),
+		0,
+		uintptr(unsafe.Pointer(&info)),
+		0,
+		0,
+	)
+	if r0 == 0 {
+		return fmt.Errorf("CertSetCertificateContextProperty: %v", e1)
+	}
+	return nil
+}
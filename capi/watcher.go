@@ -0,0 +1,77 @@
+package capi
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	CERT_STORE_CTRL_RESYNC        = 1
+	CERT_STORE_CTRL_NOTIFY_CHANGE = 2
+)
+
+var procCertControlStore = modcrypt32.NewProc("CertControlStore")
+
+func certControlStore(store syscall.Handle, ctrlType uint32, event *windows.Handle) error {
+	r0, _, e1 := syscall.Syscall6(procCertControlStore.Addr(), 4,
+		uintptr(store),
+		0,
+		uintptr(ctrlType),
+		uintptr(unsafe.Pointer(event)),
+		0,
+		0,
+	)
+	if r0 == 0 {
+		return e1
+	}
+	return nil
+}
+
+// StoreWatcher signals changes of the current user's My store, e.g. a smart card being inserted.
+type StoreWatcher struct {
+	store syscall.Handle
+	event windows.Handle
+}
+
+func WatchUserStore() (*StoreWatcher, error) {
+	store, err := openUserStore()
+	if err != nil {
+		return nil, err
+	}
+	event, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		syscall.CertCloseStore(store, 0)
+		return nil, err
+	}
+	err = certControlStore(store, CERT_STORE_CTRL_NOTIFY_CHANGE, &event)
+	if err != nil {
+		windows.CloseHandle(event)
+		syscall.CertCloseStore(store, 0)
+		return nil, err
+	}
+	return &StoreWatcher{
+		store: store,
+		event: event,
+	}, nil
+}
+
+// Wait returns true if the store has changed within timeout.
+func (s *StoreWatcher) Wait(timeout time.Duration) (bool, error) {
+	r, err := windows.WaitForSingleObject(s.event, uint32(timeout/time.Millisecond))
+	if r == windows.WAIT_OBJECT_0 {
+		// resync the store and rearm the event
+		return true, certControlStore(s.store, CERT_STORE_CTRL_RESYNC, &s.event)
+	}
+	if r == uint32(windows.WAIT_TIMEOUT) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *StoreWatcher) Close() error {
+	windows.CloseHandle(s.event)
+	return syscall.CertCloseStore(s.store, 0)
+}
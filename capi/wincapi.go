@@ -1,7 +1,9 @@
 package capi
 
 import (
+	"crypto"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/fullsailor/pkcs7"
 	"syscall"
@@ -31,6 +33,10 @@ const (
 	PKCS_7_ASN_ENCODING                = 0x10000
 	CRYPT_ACQUIRE_CACHE_FLAG           = uint32(0x00000001)
 	CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG = uint32(0x00040000)
+
+	CERT_SYSTEM_STORE_CURRENT_USER  = uint32(0x00010000)
+	CERT_SYSTEM_STORE_LOCAL_MACHINE = uint32(0x00020000)
+	CERT_STORE_READONLY_FLAG        = uint32(0x00008000)
 )
 
 var (
@@ -173,18 +179,43 @@ func cryptAcquireCertificatePrivateKey(certContext uintptr, flags uint32) (provC
 	)
 
 	if r0 == 0 {
+		if e1 != syscall.Errno(0) {
+			return 0, e1
+		}
 		return 0, fmt.Errorf("r0 was 0")
 	}
 
-	if e1 != syscall.Errno(0) {
-		return 0, e1
-	}
-
 	return phCryptProvOrNCryptKey, nil
 }
 
+// ErrNotNCryptKey is returned by SignHash for keys of legacy CSPs, they are signed with Sign instead.
+var ErrNotNCryptKey = errors.New("capi: not a CNG key")
+
+// errors of CryptAcquireCertificatePrivateKey with CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG for keys of legacy CSPs,
+// NTE_BAD_KEYSET is also returned for keys of a removed smart card
+const (
+	NTE_BAD_PROVIDER        = syscall.Errno(0x80090013)
+	NTE_PROV_TYPE_NOT_DEF   = syscall.Errno(0x80090017)
+	NTE_BAD_KEYSET          = syscall.Errno(0x80090016)
+	NTE_NOT_SUPPORTED       = syscall.Errno(0x80090029)
+	CRYPT_E_NO_KEY_PROPERTY = syscall.Errno(0x8009200B)
+)
+
+// notNCryptKey reports whether err means that the key of a certificate is not a CNG key,
+// other errors, e.g. a removed smart card or a cancelled PIN prompt, may be gone next time.
+func notNCryptKey(err error) bool {
+	switch err {
+	case NTE_BAD_PROVIDER, NTE_PROV_TYPE_NOT_DEF, NTE_NOT_SUPPORTED, CRYPT_E_NO_KEY_PROPERTY:
+		return true
+	}
+	return false
+}
+
 type Certificate struct {
 	certContext uintptr
+	key         *NCryptKey
+	legacy      bool
+	keyFailed   bool
 	*x509.Certificate
 }
 
@@ -204,29 +235,44 @@ func (s *Certificate) Copy() (*Certificate, error) {
 	}, nil
 }
 
-func LoadUserCerts() ([]*Certificate, error) {
+func openSystemStore(location uint32, name string, flags uint32) (syscall.Handle, error) {
 	const (
-		CERT_STORE_PROV_SYSTEM_A       = 9
-		CERT_SYSTEM_STORE_CURRENT_USER = 0x00010000
-		CERT_STORE_READONLY_FLAG       = 0x00008000
-		CRYPT_E_NOT_FOUND              = 0x80092004
-		CERT_KEY_SPEC_PROP_ID          = 6
+		CERT_STORE_PROV_SYSTEM_A = 9
 	)
-	ptr, _ := syscall.BytePtrFromString("My")
-	store, err := syscall.CertOpenStore(
+	ptr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	return syscall.CertOpenStore(
 		CERT_STORE_PROV_SYSTEM_A,
 		0,
 		0,
-		CERT_SYSTEM_STORE_CURRENT_USER|CERT_STORE_READONLY_FLAG,
+		location|flags,
 		uintptr(unsafe.Pointer(ptr)),
 	)
-	if err != nil {
-		return nil, err
-	}
-	defer syscall.CertCloseStore(store, 0)
+}
+
+func openUserStore() (syscall.Handle, error) {
+	return openSystemStore(CERT_SYSTEM_STORE_CURRENT_USER, "My", CERT_STORE_READONLY_FLAG)
+}
 
+// certHasProperty reports whether a property is set, regardless of its size.
+func certHasProperty(context *syscall.CertContext, dwPropId uint32) bool {
+	pcbData := uint32(0)
+	r0, _, _ := syscall.Syscall6(procCertGetCertificateContextProperty.Addr(), 4, uintptr(unsafe.Pointer(context)), uintptr(dwPropId), 0, uintptr(unsafe.Pointer(&pcbData)), 0, 0)
+	return r0 != 0
+}
+
+// loadCerts returns the certificates of a store which have a private key.
+func loadCerts(store syscall.Handle) ([]*Certificate, error) {
+	const (
+		CRYPT_E_NOT_FOUND              = 0x80092004
+		CERT_KEY_SPEC_PROP_ID          = 6
+		CERT_NCRYPT_KEY_HANDLE_PROP_ID = 78
+	)
 	certs := make([]*Certificate, 0)
 	var cert *syscall.CertContext
+	var err error
 	for {
 		cert, err = syscall.CertEnumCertificatesInStore(store, cert)
 		if err != nil {
@@ -240,9 +286,9 @@ func LoadUserCerts() ([]*Certificate, error) {
 		if cert == nil {
 			break
 		}
-		// Check private key
+		// Check private key, keys of PFX files imported without persisting only have a handle
 		propID := certGetCertificateContextProperty(cert, CERT_KEY_SPEC_PROP_ID)
-		if propID == 0 {
+		if propID == 0 && !certHasProperty(cert, CERT_NCRYPT_KEY_HANDLE_PROP_ID) {
 			continue
 		}
 		// Copy the buf, since ParseCertificate does not create its own copy.
@@ -255,14 +301,23 @@ func LoadUserCerts() ([]*Certificate, error) {
 				continue
 			}
 			certs = append(certs, &Certificate{
-				cc,
-				c,
+				certContext: cc,
+				Certificate: c,
 			})
 		}
 	}
 	return certs, nil
 }
 
+func LoadUserCerts() ([]*Certificate, error) {
+	store, err := openUserStore()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CertCloseStore(store, 0)
+	return loadCerts(store)
+}
+
 func Sign(alg string, cert *Certificate, data []byte) (*pkcs7.PKCS7, error) {
 	var nCryptHandle uintptr
 
@@ -302,6 +357,49 @@ func Sign(alg string, cert *Certificate, data []byte) (*pkcs7.PKCS7, error) {
 	return pkcs7.Parse(sign)
 }
 
+// SignHash signs a digest of data with NCryptSignHash, the key handle is acquired once and cached
+// with the certificate context. RSA signatures use PKCS #1 v1.5, ECDSA signatures are r || s.
+func (s *Certificate) SignHash(digest []byte, hash crypto.Hash) ([]byte, error) {
+	if s.legacy {
+		return nil, ErrNotNCryptKey
+	}
+	if s.key == nil {
+		acquireFlags := uint32(CRYPT_ACQUIRE_CACHE_FLAG | CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG)
+		handle, err := cryptAcquireCertificatePrivateKey(s.certContext, acquireFlags)
+		if notNCryptKey(err) {
+			s.legacy = true
+			return nil, ErrNotNCryptKey
+		}
+		if err == NTE_BAD_KEYSET {
+			// a key of a legacy CSP or of a removed card, CNG is tried again next time
+			return nil, ErrNotNCryptKey
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the handle belongs to the certificate context because of CRYPT_ACQUIRE_CACHE_FLAG
+		s.key = &NCryptKey{handle: handle, public: s.PublicKey}
+	}
+	sig, err := s.key.SignHash(digest, hash)
+	if err != nil {
+		s.keyFailed = true
+		return nil, err
+	}
+	if disablePINCache {
+		// Set the PIN to NULL so we are prompted again
+		if err := nCryptSetPropertyString(s.key.handle, NCRYPT_PIN_PROPERTY, "", 0); err != nil {
+			return nil, fmt.Errorf("Could not set NCRYPT_PIN_PROPERTY: %v\n", err)
+		}
+	}
+	return sig, nil
+}
+
+// KeyFailed reports whether signing with the cached key handle failed, e.g. after the card was removed.
+// The handle stays with the certificate context, so the certificate must be loaded again.
+func (s *Certificate) KeyFailed() bool {
+	return s.keyFailed
+}
+
 func SetDisablePINCache(b bool) {
 	disablePINCache = b
 }
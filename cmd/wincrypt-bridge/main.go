@@ -0,0 +1,253 @@
+//go:build linux
+// +build linux
+
+// wincrypt-bridge serves the agent of WinCryptSSHAgent on the Windows host
+// as a Unix socket in WSL2 and Linux Hyper-V guests.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+// hostPort is the AF_VSOCK port of the Hyper-V socket service of WinCryptSSHAgent.
+const hostPort = 0x22223333
+
+// systemd passes sockets starting with this file descriptor
+const listenFdsStart = 3
+
+var (
+	socketPath = flag.String("a", defaultSocketPath(), "Bind the agent socket to this path")
+	cshell     = flag.Bool("c", false, "Print csh style commands to set SSH_AUTH_SOCK")
+	bshell     = flag.Bool("s", false, "Print sh style commands to set SSH_AUTH_SOCK (default unless SHELL ends with csh)")
+	foreground = flag.Bool("D", false, "Stay in the foreground")
+	timeout    = flag.Duration("t", 5*time.Second, "Timeout connecting to the Windows host")
+	localAgent = flag.String("l", "", "Also serve the keys of the Linux agent on this socket, keys added with ssh-add go there")
+)
+
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "wincrypt-hv.sock")
+	}
+	return "/tmp/wincrypt-hv.sock"
+}
+
+// dialHost connects to the agent on the Windows host over AF_VSOCK.
+func dialHost() (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("AF_VSOCK is not available, this is not WSL2 or a Hyper-V guest: %v", err)
+	}
+	// a blocking connect of AF_VSOCK waits for the connect timeout of the socket, not SO_SNDTIMEO
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_CONNECT_TIMEOUT, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_HOST, Port: hostPort}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("cannot connect to WinCryptSSHAgent on the Windows host, is it running with the Hyper-V service installed (-i)? %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "vsock")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// dial connects to the agent on the Windows host, tests replace it.
+var dial = dialHost
+
+func relay(conn net.Conn) {
+	defer conn.Close()
+	if *localAgent != "" {
+		mux := newMuxAgent(
+			&bridgeLock,
+			&backend{name: "local agent", dial: func() (net.Conn, error) { return net.DialTimeout("unix", *localAgent, *timeout) }},
+			&backend{name: "Windows host", dial: dial},
+		)
+		defer mux.close()
+		if err := agent.ServeAgent(mux, conn); err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, "wincrypt-bridge:", err)
+		}
+		return
+	}
+	host, err := dial()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "wincrypt-bridge:", err)
+		return
+	}
+	defer host.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		io.Copy(host, conn)
+		if c, ok := host.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+		wg.Done()
+	}()
+	io.Copy(conn, host)
+	wg.Wait()
+}
+
+// systemdListener returns the socket passed by systemd socket activation at file descriptor fd, or nil.
+func systemdListener(fd uintptr) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, errors.New("only one socket can be passed by systemd")
+	}
+	unix.CloseOnExec(int(fd))
+	f := os.NewFile(fd, "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func listen(path string) (net.Listener, error) {
+	// another bridge may already serve the socket
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, nil
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// sameSocket reports whether two socket paths, which may be relative, name the same file.
+func sameSocket(a, b string) bool {
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false
+	}
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return false
+	}
+	return a == b
+}
+
+func printEnv(w io.Writer, path string) {
+	csh := *cshell || (!*bshell && strings.HasSuffix(os.Getenv("SHELL"), "csh"))
+	if csh {
+		fmt.Fprintf(w, "setenv SSH_AUTH_SOCK %s;\n", path)
+	} else {
+		fmt.Fprintf(w, "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", path)
+	}
+}
+
+// daemonize starts the bridge again in the background on the listening socket.
+func daemonize(l net.Listener) error {
+	f, err := l.(*net.UnixListener).File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"-D", "-a", *socketPath, "-t", timeout.String()}
+	if *localAgent != "" {
+		args = append(args, "-l", *localAgent)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), "WINCRYPT_BRIDGE_FD=3")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd.Start()
+}
+
+func run() error {
+	l, err := systemdListener(listenFdsStart)
+	if err != nil {
+		return err
+	}
+	if l == nil && os.Getenv("WINCRYPT_BRIDGE_FD") != "" {
+		f := os.NewFile(listenFdsStart, "bridge")
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		os.Unsetenv("WINCRYPT_BRIDGE_FD")
+	}
+	if *localAgent != "" && sameSocket(*localAgent, *socketPath) {
+		return errors.New("the local agent socket is the socket of the bridge")
+	}
+	if l == nil {
+		// fail early instead of serving a socket which cannot reach the host
+		if *localAgent == "" {
+			host, err := dial()
+			if err != nil {
+				return err
+			}
+			host.Close()
+		}
+		if l, err = listen(*socketPath); err != nil {
+			return err
+		}
+		if l == nil {
+			printEnv(os.Stdout, *socketPath)
+			return nil
+		}
+		if !*foreground {
+			// the socket stays for the background process
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			err := daemonize(l)
+			l.Close()
+			if err != nil {
+				return err
+			}
+			printEnv(os.Stdout, *socketPath)
+			return nil
+		}
+		printEnv(os.Stdout, *socketPath)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go relay(conn)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "wincrypt-bridge:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,251 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wincrypt-bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func setEnv(t *testing.T, key, value string) {
+	old, set := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// socketPair returns both ends of a connected Unix socket.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conns[0], conns[1]
+}
+
+// serveAgent returns a dialer of connections served by an in-memory agent.
+func serveAgent(t *testing.T, keyring agent.Agent) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		client, server := socketPair(t)
+		go func() {
+			agent.ServeAgent(keyring, server)
+			server.Close()
+		}()
+		return client, nil
+	}
+}
+
+// fakeHost replaces the AF_VSOCK dialer with an in-memory agent standing in for the Windows host.
+func fakeHost(t *testing.T, keyring agent.Agent) {
+	old := dial
+	dial = serveAgent(t, keyring)
+	t.Cleanup(func() { dial = old })
+}
+
+func newKey(t *testing.T, comment string) agent.AddedKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agent.AddedKey{PrivateKey: priv, Comment: comment}
+}
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.sock")
+
+	l, err := listen(path)
+	if err != nil || l == nil {
+		t.Fatalf("listen() = %v, %v, want a listener", l, err)
+	}
+	go func(l net.Listener) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}(l)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	// another bridge serves the socket
+	if l2, err := listen(path); err != nil || l2 != nil {
+		t.Errorf("listen() of a served socket = %v, %v, want nil, nil", l2, err)
+	}
+
+	// a socket left behind by a bridge which is gone
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listen(path)
+	if err != nil || l == nil {
+		t.Fatalf("listen() of a stale socket = %v, %v, want a listener", l, err)
+	}
+	l.Close()
+}
+
+func TestSameSocket(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameSocket("agent.sock", filepath.Join(wd, "agent.sock")) {
+		t.Error("a relative path is not the same socket as its absolute path")
+	}
+	if !sameSocket("dir/../agent.sock", "./agent.sock") {
+		t.Error("two relative paths of a socket are not the same socket")
+	}
+	if sameSocket("agent.sock", filepath.Join(wd, "other.sock")) {
+		t.Error("two sockets are the same socket")
+	}
+}
+
+func TestPrintEnv(t *testing.T) {
+	defer func(c, s bool) { *cshell, *bshell = c, s }(*cshell, *bshell)
+	tests := []struct {
+		shell  string
+		c, s   bool
+		output string
+	}{
+		{"/bin/bash", false, false, "SSH_AUTH_SOCK=/run/a.sock; export SSH_AUTH_SOCK;\n"},
+		{"/bin/tcsh", false, false, "setenv SSH_AUTH_SOCK /run/a.sock;\n"},
+		{"/bin/bash", true, false, "setenv SSH_AUTH_SOCK /run/a.sock;\n"},
+		{"/bin/tcsh", false, true, "SSH_AUTH_SOCK=/run/a.sock; export SSH_AUTH_SOCK;\n"},
+	}
+	for _, tt := range tests {
+		setEnv(t, "SHELL", tt.shell)
+		*cshell, *bshell = tt.c, tt.s
+		var out bytes.Buffer
+		printEnv(&out, "/run/a.sock")
+		if out.String() != tt.output {
+			t.Errorf("printEnv() with SHELL=%s -c=%v -s=%v = %q, want %q", tt.shell, tt.c, tt.s, out.String(), tt.output)
+		}
+	}
+}
+
+func TestSystemdListener(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.sock")
+	ul, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	// a file descriptor owned by nothing else, like the one passed by systemd
+	f, err := ul.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := unix.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := uintptr(dup)
+
+	setEnv(t, "LISTEN_PID", "1")
+	setEnv(t, "LISTEN_FDS", "1")
+	if l, err := systemdListener(fd); err != nil || l != nil {
+		t.Errorf("systemdListener() for another process = %v, %v, want nil, nil", l, err)
+	}
+
+	setEnv(t, "LISTEN_PID", strconv.Itoa(os.Getpid()))
+	setEnv(t, "LISTEN_FDS", "2")
+	if _, err := systemdListener(fd); err == nil {
+		t.Error("systemdListener() with two sockets succeeded")
+	}
+
+	setEnv(t, "LISTEN_FDS", "1")
+	l, err := systemdListener(fd)
+	if err != nil || l == nil {
+		t.Fatalf("systemdListener() = %v, %v, want a listener", l, err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestRelay(t *testing.T) {
+	defer func(l string) { *localAgent = l }(*localAgent)
+	*localAgent = ""
+	host := agent.NewKeyring()
+	key := newKey(t, "host key")
+	if err := host.Add(key); err != nil {
+		t.Fatal(err)
+	}
+	fakeHost(t, host)
+
+	client, bridge := socketPair(t)
+	done := make(chan struct{})
+	go func() {
+		relay(bridge)
+		close(done)
+	}()
+
+	ag := agent.NewClient(client)
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "host key" {
+		t.Fatalf("List() = %v, want the host key", keys)
+	}
+	pub, _ := ssh.NewPublicKey(key.PrivateKey.(ed25519.PrivateKey).Public())
+	sig, err := ag.Sign(pub, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify([]byte("data"), sig); err != nil {
+		t.Error(err)
+	}
+
+	client.Close()
+	<-done
+}
@@ -0,0 +1,240 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// backend is an agent connected on first use and kept for one client connection.
+type backend struct {
+	name   string
+	dial   func() (net.Conn, error)
+	conn   net.Conn
+	client agent.ExtendedAgent
+	err    error
+}
+
+func (b *backend) agent() (agent.ExtendedAgent, error) {
+	if b.client == nil && b.err == nil {
+		b.conn, b.err = b.dial()
+		if b.err != nil {
+			fmt.Fprintln(os.Stderr, "wincrypt-bridge:", b.name+":", b.err)
+		} else {
+			b.client = agent.NewClient(b.conn)
+		}
+	}
+	return b.client, b.err
+}
+
+func (b *backend) close() {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+var errLocked = errors.New("agent: locked")
+
+// muxLock is the lock of the bridge, shared by the connections of all clients.
+type muxLock struct {
+	mu         sync.Mutex
+	locked     bool
+	passphrase []byte
+}
+
+func (l *muxLock) isLocked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.locked
+}
+
+// bridgeLock is the lock of this bridge process.
+var bridgeLock muxLock
+
+// muxAgent serves the keys of the local Linux agent and of the Windows host like the
+// composed agent of WinCryptSSHAgent: keys are listed in order, signatures go to the
+// agent owning the key, and keys added with ssh-add go to the local agent.
+//
+// Locking the bridge also locks the local agent, but never the agent of the Windows host,
+// which serves other clients too. The host keys are hidden by the bridge until it is unlocked.
+type muxAgent struct {
+	lock     *muxLock
+	backends []*backend
+}
+
+func newMuxAgent(lock *muxLock, local, host *backend) *muxAgent {
+	return &muxAgent{lock: lock, backends: []*backend{local, host}}
+}
+
+func (m *muxAgent) close() {
+	for _, b := range m.backends {
+		b.close()
+	}
+}
+
+func (m *muxAgent) List() ([]*agent.Key, error) {
+	if m.lock.isLocked() {
+		return nil, nil
+	}
+	var all []*agent.Key
+	for _, b := range m.backends {
+		ag, err := b.agent()
+		if err != nil {
+			continue
+		}
+		keys, err := ag.List()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "wincrypt-bridge:", b.name+":", err)
+			continue
+		}
+		all = append(all, keys...)
+	}
+	return all, nil
+}
+
+// owner returns the agent listing key.
+func (m *muxAgent) owner(key ssh.PublicKey) (agent.ExtendedAgent, error) {
+	wanted := key.Marshal()
+	for _, b := range m.backends {
+		ag, err := b.agent()
+		if err != nil {
+			continue
+		}
+		keys, err := ag.List()
+		if err != nil {
+			continue
+		}
+		for _, k := range keys {
+			if bytes.Equal(k.Blob, wanted) {
+				return ag, nil
+			}
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (m *muxAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return m.SignWithFlags(key, data, 0)
+}
+
+func (m *muxAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if m.lock.isLocked() {
+		return nil, errLocked
+	}
+	ag, err := m.owner(key)
+	if err != nil {
+		return nil, err
+	}
+	return ag.SignWithFlags(key, data, flags)
+}
+
+func (m *muxAgent) Add(key agent.AddedKey) error {
+	if m.lock.isLocked() {
+		return errLocked
+	}
+	ag, err := m.backends[0].agent()
+	if err != nil {
+		return err
+	}
+	return ag.Add(key)
+}
+
+func (m *muxAgent) Remove(key ssh.PublicKey) error {
+	if m.lock.isLocked() {
+		return errLocked
+	}
+	ag, err := m.owner(key)
+	if err != nil {
+		return err
+	}
+	return ag.Remove(key)
+}
+
+// RemoveAll only removes the keys of the local agent, the keys of the host stay.
+func (m *muxAgent) RemoveAll() error {
+	if m.lock.isLocked() {
+		return errLocked
+	}
+	ag, err := m.backends[0].agent()
+	if err != nil {
+		return err
+	}
+	return ag.RemoveAll()
+}
+
+// Lock locks the bridge and the local agent, an unreachable local agent is not locked.
+// The local agent is dialed before taking the lock, so other clients do not wait for it.
+func (m *muxAgent) Lock(passphrase []byte) error {
+	local, err := m.backends[0].agent()
+
+	m.lock.mu.Lock()
+	defer m.lock.mu.Unlock()
+
+	if m.lock.locked {
+		return errLocked
+	}
+	if err == nil {
+		if err := local.Lock(passphrase); err != nil {
+			return err
+		}
+	}
+	m.lock.locked = true
+	m.lock.passphrase = passphrase
+	return nil
+}
+
+// Unlock unlocks the bridge and the local agent, the bridge stays locked if the local agent
+// cannot be unlocked. An unreachable local agent is skipped as by Lock.
+func (m *muxAgent) Unlock(passphrase []byte) error {
+	local, err := m.backends[0].agent()
+
+	m.lock.mu.Lock()
+	defer m.lock.mu.Unlock()
+
+	if !m.lock.locked {
+		return errors.New("agent: not locked")
+	}
+	if subtle.ConstantTimeCompare(passphrase, m.lock.passphrase) != 1 {
+		return errors.New("agent: incorrect passphrase")
+	}
+	if err == nil {
+		if err := local.Unlock(passphrase); err != nil {
+			return fmt.Errorf("%s: %v", m.backends[0].name, err)
+		}
+	}
+	m.lock.locked = false
+	m.lock.passphrase = nil
+	return nil
+}
+
+func (m *muxAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("agent: signers are not supported")
+}
+
+func (m *muxAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if m.lock.isLocked() {
+		return nil, errLocked
+	}
+	for _, b := range m.backends {
+		ag, err := b.agent()
+		if err != nil {
+			continue
+		}
+		resp, err := ag.Extension(extensionType, contents)
+		if err != agent.ErrExtensionUnsupported {
+			return resp, err
+		}
+	}
+	return nil, agent.ErrExtensionUnsupported
+}
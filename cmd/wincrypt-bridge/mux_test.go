@@ -0,0 +1,200 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func publicKey(t *testing.T, key agent.AddedKey) ssh.PublicKey {
+	pub, err := ssh.NewPublicKey(key.PrivateKey.(ed25519.PrivateKey).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+// newTestMux returns a mux of a local and a host keyring with one key each.
+func newTestMux(t *testing.T, lock *muxLock) (m *muxAgent, local, host agent.Agent, localKey, hostKey ssh.PublicKey) {
+	local, host = agent.NewKeyring(), agent.NewKeyring()
+	lk, hk := newKey(t, "local key"), newKey(t, "host key")
+	if err := local.Add(lk); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Add(hk); err != nil {
+		t.Fatal(err)
+	}
+	m = newMuxAgent(lock,
+		&backend{name: "local agent", dial: serveAgent(t, local)},
+		&backend{name: "Windows host", dial: serveAgent(t, host)},
+	)
+	t.Cleanup(m.close)
+	return m, local, host, publicKey(t, lk), publicKey(t, hk)
+}
+
+func comments(keys []*agent.Key) []string {
+	var c []string
+	for _, k := range keys {
+		c = append(c, k.Comment)
+	}
+	return c
+}
+
+func TestMuxListSign(t *testing.T) {
+	m, _, _, localKey, hostKey := newTestMux(t, new(muxLock))
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := comments(keys); len(c) != 2 || c[0] != "local key" || c[1] != "host key" {
+		t.Fatalf("List() = %v, want the local key followed by the host key", c)
+	}
+	for _, key := range []ssh.PublicKey{localKey, hostKey} {
+		sig, err := m.SignWithFlags(key, []byte("data"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := key.Verify([]byte("data"), sig); err != nil {
+			t.Error(err)
+		}
+	}
+	other := newKey(t, "other")
+	if _, err := m.Sign(publicKey(t, other), []byte("data")); err == nil {
+		t.Error("signed with a key of no agent")
+	}
+}
+
+func TestMuxUnreachableHost(t *testing.T) {
+	local := agent.NewKeyring()
+	if err := local.Add(newKey(t, "local key")); err != nil {
+		t.Fatal(err)
+	}
+	m := newMuxAgent(new(muxLock),
+		&backend{name: "local agent", dial: serveAgent(t, local)},
+		&backend{name: "Windows host", dial: func() (net.Conn, error) { return nil, errors.New("unreachable") }},
+	)
+	defer m.close()
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := comments(keys); len(c) != 1 || c[0] != "local key" {
+		t.Errorf("List() = %v, want only the local key", c)
+	}
+}
+
+func TestMuxAddRemove(t *testing.T) {
+	m, local, host, _, hostKey := newTestMux(t, new(muxLock))
+
+	if err := m.Add(newKey(t, "added")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := local.List(); len(keys) != 2 {
+		t.Errorf("local agent has %d keys, want the added key too", len(keys))
+	}
+	if err := m.Remove(hostKey); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := host.List(); len(keys) != 0 {
+		t.Error("host key not removed from the host")
+	}
+	if err := host.Add(newKey(t, "host key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := local.List(); len(keys) != 0 {
+		t.Error("local keys not removed")
+	}
+	if keys, _ := host.List(); len(keys) != 1 {
+		t.Error("RemoveAll removed the keys of the host")
+	}
+}
+
+func TestMuxLock(t *testing.T) {
+	lock := new(muxLock)
+	m, local, host, localKey, hostKey := newTestMux(t, lock)
+
+	if err := m.Lock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := host.List(); err != nil || len(keys) != 1 {
+		t.Error("the agent of the host was locked")
+	}
+	if keys, _ := local.List(); len(keys) != 0 {
+		t.Error("the local agent was not locked")
+	}
+	if keys, err := m.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List() of a locked bridge = %v, %v, want no keys", comments(keys), err)
+	}
+	if _, err := m.Sign(hostKey, []byte("data")); err == nil {
+		t.Error("signed with a host key while locked")
+	}
+	if err := m.Add(newKey(t, "added")); err == nil {
+		t.Error("added a key while locked")
+	}
+
+	// the lock is shared by the connections of other clients
+	other, _, _, _, _ := newTestMux(t, lock)
+	if keys, err := other.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List() of another client = %v, %v, want no keys", comments(keys), err)
+	}
+	if err := other.Lock([]byte("secret")); err == nil {
+		t.Error("locked a locked bridge")
+	}
+
+	if err := m.Unlock([]byte("wrong")); err == nil {
+		t.Error("unlocked with a wrong passphrase")
+	}
+	if err := m.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := local.List(); len(keys) != 1 {
+		t.Error("the local agent was not unlocked")
+	}
+	for _, key := range []ssh.PublicKey{localKey, hostKey} {
+		if _, err := m.Sign(key, []byte("data")); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := m.Unlock([]byte("secret")); err == nil {
+		t.Error("unlocked a bridge which is not locked")
+	}
+}
+
+func TestMuxUnlockLocalAgent(t *testing.T) {
+	m, local, _, _, _ := newTestMux(t, new(muxLock))
+	if err := m.Lock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	// the local agent is unlocked by another client, its unlock through the bridge fails
+	if err := local.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unlock([]byte("secret")); err == nil {
+		t.Error("Unlock() succeeded although the local agent failed to unlock")
+	}
+	if !m.lock.isLocked() {
+		t.Error("the bridge was unlocked although the local agent failed to unlock")
+	}
+}
+
+func TestMuxExtension(t *testing.T) {
+	m, _, _, _, _ := newTestMux(t, new(muxLock))
+	if _, err := m.Extension("unknown@example.com", nil); err != agent.ErrExtensionUnsupported {
+		t.Errorf("Extension() = %v, want %v", err, agent.ErrExtensionUnsupported)
+	}
+	if _, err := m.Signers(); err == nil {
+		t.Error("Signers() succeeded")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"io/ioutil"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/buptczq/WinCryptSSHAgent/app"
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	csrKey     = flag.String("csr-key", "", "CSR mode: common name, serial number or SHA256 fingerprint of the key (store or running agent)")
+	csrSubject = flag.String("csr-subject", "", "CSR mode: subject, RFC 4514 distinguished name, e.g. CN=alice,O=Example\\, Inc. (default: CN=<key comment>)")
+	csrSANs    = flag.String("csr-san", "", "CSR mode: comma separated DNS names, emails, IP addresses or URIs")
+	csrEKUs    = flag.String("csr-eku", "clientAuth", "CSR mode: comma separated extended key usages (names or OIDs)")
+	csrOut     = flag.String("csr-out", "", "CSR mode: output PEM file")
+)
+
+func runCSR() {
+	pemData, err := certificateRequest()
+	if err != nil {
+		utils.MessageBox("CSR Error:", err.Error(), utils.MB_ICONERROR)
+		return
+	}
+	if *csrOut != "" {
+		if err := ioutil.WriteFile(*csrOut, pemData, 0644); err != nil {
+			utils.MessageBox("CSR Error:", err.Error(), utils.MB_ICONERROR)
+		}
+		return
+	}
+	if utils.MessageBox("Certificate Signing Request (OK to copy):", string(pemData), utils.MB_OKCANCEL) == utils.IDOK {
+		utils.SetClipBoard(string(pemData))
+	}
+}
+
+func certificateRequest() ([]byte, error) {
+	req := &sshagent.CSRRequest{
+		Subject: *csrSubject,
+		SANs:    splitList(*csrSANs),
+		EKUs:    splitList(*csrEKUs),
+	}
+
+	cag := new(sshagent.CAPIAgent)
+	defer cag.Close()
+	signer, comment, err := cag.Signer(*csrKey)
+	if err == nil {
+		if req.Subject == "" {
+			req.Subject = (&pkix.Name{CommonName: comment}).String()
+		}
+		return sshagent.CreateCertificateRequest(signer, req)
+	}
+
+	// keyring keys only live in the running agent
+	conn, err := winio.DialPipe(app.NAMED_PIPE, nil)
+	if err != nil {
+		return nil, errors.New("csr: key <" + *csrKey + "> not found")
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+		if _, ok := pub.(*ssh.Certificate); ok {
+			continue
+		}
+		if k.Comment == *csrKey || ssh.FingerprintSHA256(pub) == *csrKey {
+			if req.Subject == "" {
+				req.Subject = (&pkix.Name{CommonName: k.Comment}).String()
+			}
+			return sshagent.CreateCertificateRequest(sshagent.NewAgentSigner(client, pub), req)
+		}
+	}
+	return nil, errors.New("csr: key <" + *csrKey + "> not found")
+}
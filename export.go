@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/buptczq/WinCryptSSHAgent/app"
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	exportFormat  = flag.String("export", "", "Export mode: write public keys to stdout (authorized_keys, rfc4716, pkix, sha256, md5, randomart, x509, thumbprint)")
+	exportKey     = flag.String("export-key", "", "Export mode: comment or SHA256 fingerprint of the key (default: all keys)")
+	exportOptions = flag.String("export-options", "", "Export mode: options prepended to authorized_keys lines, e.g. from=\"10.0.0.0/8\"")
+)
+
+func runExport() {
+	if err := exportKeys(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func exportKeys() error {
+	cag := new(sshagent.CAPIAgent)
+	defer cag.Close()
+
+	// prefer the running agent, it also knows keys added with ssh-add
+	local := sshagent.NewComposedAgent(cag)
+	var ag agent.Agent = local
+	if conn, err := winio.DialPipe(app.NAMED_PIPE, nil); err == nil {
+		defer conn.Close()
+		ag = agent.NewClient(conn)
+	}
+	keys, err := ag.List()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, key := range keys {
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		if *exportKey != "" && key.Comment != *exportKey && ssh.FingerprintSHA256(pub) != *exportKey {
+			continue
+		}
+		found = true
+		text, err := sshagent.ExportPublicKey(local, key, *exportFormat, *exportOptions)
+		if err != nil {
+			return err
+		}
+		fmt.Println(text)
+	}
+	if !found {
+		return errors.New("export: no keys")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	keygenName     = flag.String("keygen", "", "Key generation mode: create a key with a self-signed certificate of this common name and write its public key to stdout")
+	keygenType     = flag.String("keygen-type", "rsa", "Key generation mode: rsa or ecdsa")
+	keygenBits     = flag.Int("keygen-bits", 0, "Key generation mode: RSA modulus size or ECDSA curve size (default: 2048 or 256)")
+	keygenProvider = flag.String("keygen-provider", "software", "Key generation mode: software, tpm, smartcard or the name of a key storage provider")
+	keygenValidity = flag.Duration("keygen-validity", 10*365*24*time.Hour, "Key generation mode: certificate validity")
+)
+
+func runKeygen() {
+	pub, err := sshagent.GenerateKey(&sshagent.KeyRequest{
+		Provider:   *keygenProvider,
+		Type:       *keygenType,
+		Bits:       *keygenBits,
+		CommonName: *keygenName,
+		Validity:   *keygenValidity,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + *keygenName)
+}
@@ -4,11 +4,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"github.com/buptczq/WinCryptSSHAgent/capi"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,6 +29,8 @@ const agentTitle = "WinCrypt SSH Agent v1.1.9"
 
 var applications = []app.Application{
 	new(app.PubKeyView),
+	new(app.PubKeySync),
+	new(app.NewKey),
 	new(app.WSL),
 	new(app.VSock),
 	new(app.Cygwin),
@@ -38,6 +42,42 @@ var applications = []app.Application{
 var installHVService = flag.Bool("i", false, "Install Hyper-V Guest Communication Services")
 var disableCapi = flag.Bool("disable-capi", false, "Disable Windows Crypto API")
 var disablePINCache = flag.Bool("disable-pin-cache", false, "Clear the Smart Card PIN Cache after each operation")
+var enableX509v3 = flag.Bool("x509v3", false, "Also offer certificates as RFC 6187 x509v3-* identities")
+var persistCerts = flag.Bool("persist-certs", false, "Save OpenSSH certificates attached with ssh-add to the user profile folder")
+var persistHidden = flag.Bool("persist-hidden", false, "Remember certificate store keys hidden with ssh-add -d/-D across restarts")
+var importKeys = flag.Bool("import-keys", false, "Import keys added with ssh-add into the Windows key store as non-exportable keys, not only those with a \""+sshagent.ImportCommentPrefix+"\" comment")
+var importProvider = flag.String("import-provider", capi.MS_KEY_STORAGE_PROVIDER, "CNG key storage provider for keys imported with ssh-add")
+var hvReadOnly = flag.Bool("hv-readonly", false, "Refuse requests of Hyper-V guests and WSL2 which add, remove or lock keys")
+var cngKeys = flag.String("cng-keys", "", "Also serve persisted keys without a certificate from these comma separated key storage providers: software, tpm, smartcard or provider names")
+
+var pubkeyDir = flag.String("pubkey-dir", "", "Keep a .pub file for each key in this directory, e.g. %USERPROFILE%\\.ssh\\wincrypt")
+var pubkeyName = flag.String("pubkey-name", app.DEFAULT_PUBKEY_NAME, "File name template of .pub files: {comment}, {fingerprint}, {type}")
+var keySources stringList
+var upstreams stringList
+var vmAllow stringList
+var vmAccess = flag.Bool("vm-access", false, "Ask before a virtual machine or WSL2 uses the agent for the first time, implied by -vm-allow")
+var pkcs11Modules = flag.String("pkcs11", "", "Load these comma separated PKCS #11 modules at startup, the PIN is asked for")
+var pkcs11Allow = flag.String("pkcs11-allow", "", "Comma separated folders ssh-add -s may load PKCS #11 modules from (default: Program Files and System32)")
+
+// stringList is a flag which can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func init() {
+	flag.Var(&upstreams, "upstream", "Also serve the keys of another agent: <name>=<\\\\.\\pipe\\name|unix:path|tcp:host:port> (repeatable)")
+	flag.Var(&vmAllow, "vm-allow", "Allow a virtual machine: <VM ID or name>[=<key comment or SHA256 fingerprint>;...], WSL2 is named WSL (repeatable)")
+	flag.Var(&caOptions, "ca-options", "CA mode: critical option name[=value], e.g. source-address=10.0.0.0/8,192.168.0.0/16 (repeatable)")
+	flag.Var(&caExtensions, "ca-extensions", "CA mode: extension name[=value] (repeatable, default: ssh-keygen defaults for user certificates)")
+	flag.Var(&keySources, "key-source", "Load keys from store:<CurrentUser|LocalMachine>\\<name> or pfx:<path>, with options ;eku=any|<usages> and ;comment=<template> (repeatable, default: store:CurrentUser\\My)")
+}
 
 func installService() {
 	if !utils.IsAdmin() {
@@ -99,11 +139,35 @@ func initDebugLog() {
 func main() {
 	flag.Parse()
 	utils.SetProcessSystemDpiAware()
+	// stdout carries the agent protocol, it is not redirected to the debug log
+	if *relayMode {
+		runRelay()
+		return
+	}
 	initDebugLog()
 	if *installHVService {
 		installService()
 		return
 	}
+	if *caKey != "" {
+		capi.SetDisablePINCache(*disablePINCache)
+		runCA()
+		return
+	}
+	if *csrKey != "" {
+		capi.SetDisablePINCache(*disablePINCache)
+		runCSR()
+		return
+	}
+	if *keygenName != "" {
+		runKeygen()
+		return
+	}
+	if *exportFormat != "" {
+		capi.SetDisablePINCache(*disablePINCache)
+		runExport()
+		return
+	}
 	// hyper-v
 	hvClient := false
 	hvConn, err := utils.ConnectHyperV()
@@ -127,21 +191,29 @@ func main() {
 	capi.SetDisablePINCache(*disablePINCache)
 
 	// agent
-	var ag agent.Agent
-	if hvClient {
-		ag = sshagent.NewHVAgent()
-	} else if *disableCapi {
-		ag = sshagent.NewKeyRingAgent()
-	} else {
-		cag := new(sshagent.CAPIAgent)
-		defer cag.Close()
-		defaultAgent := sshagent.NewKeyRingAgent()
-		ag = sshagent.NewWrappedAgent(defaultAgent, []agent.Agent{agent.Agent(cag)})
+	providers, closeProviders, err := newProviders(hvClient)
+	if err != nil {
+		utils.MessageBox("Error:", err.Error(), utils.MB_ICONERROR)
+		return
 	}
+	defer closeProviders()
+	var ag agent.Agent = sshagent.NewComposedAgent(providers...)
 	ctx = context.WithValue(ctx, "agent", ag)
 	ctx = context.WithValue(ctx, "hv", hvClient)
+	ctx = context.WithValue(ctx, "pubkey-dir", *pubkeyDir)
+	ctx = context.WithValue(ctx, "pubkey-name", *pubkeyName)
 	server := &sshagent.Server{
-		Agent: ag,
+		Agent:         ag,
+		GuestReadOnly: *hvReadOnly,
+	}
+	if *vmAccess || len(vmAllow) > 0 {
+		server.VMAccess = new(sshagent.VMAccess)
+		for _, spec := range vmAllow {
+			if err := server.VMAccess.AddRule(spec); err != nil {
+				utils.MessageBox("Error:", err.Error(), utils.MB_ICONERROR)
+				return
+			}
+		}
 	}
 
 	// application
@@ -199,6 +271,76 @@ cleanup:
 	}
 }
 
+// newProviders returns the key providers of the agent and a function closing them.
+// A Hyper-V guest serves its own keys and those of the host.
+func newProviders(hvClient bool) ([]sshagent.KeyProvider, func(), error) {
+	var closers []func() error
+	upstreamAgents := make([]sshagent.KeyProvider, 0, len(upstreams))
+	for _, spec := range upstreams {
+		upstream, err := sshagent.ParseUpstream(spec)
+		if err == nil && upstream.Network == "pipe" && strings.EqualFold(upstream.Address, app.NAMED_PIPE) {
+			err = errors.New("upstream: " + upstream.Name + " is this agent")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		upstreamAgents = append(upstreamAgents, upstream)
+	}
+
+	providers := []sshagent.KeyProvider{sshagent.NewKeyRingAgent()}
+	if !*disableCapi {
+		sources := make([]*sshagent.KeySource, 0, len(keySources))
+		for _, spec := range keySources {
+			source, err := sshagent.ParseKeySource(spec)
+			if err != nil {
+				return nil, nil, err
+			}
+			sources = append(sources, source)
+		}
+		cag := &sshagent.CAPIAgent{
+			Sources:       sources,
+			X509v3:        *enableX509v3,
+			PersistCerts:  *persistCerts,
+			PersistHidden: *persistHidden,
+			KeyStore:      &sshagent.CNGKeyStore{Provider: *importProvider},
+			ImportKeys:    *importKeys,
+		}
+		closers = append(closers, cag.Close)
+		providers = append(providers, cag)
+		if *cngKeys != "" {
+			cngAgent := &sshagent.CNGAgent{Providers: splitList(*cngKeys)}
+			closers = append(closers, cngAgent.Close)
+			providers = append(providers, cngAgent)
+		}
+		p11Agent := &sshagent.PKCS11Agent{Allowed: splitList(*pkcs11Allow)}
+		closers = append(closers, p11Agent.Close)
+		for _, path := range splitList(*pkcs11Modules) {
+			pin, err := utils.PasswordPrompt("WinCrypt SSH Agent", "Enter the PIN of "+path, filepath.Base(path), false)
+			if err == utils.ErrCancelled {
+				continue
+			}
+			if err == nil {
+				err = p11Agent.LoadModule(path, pin)
+			}
+			if err != nil {
+				utils.MessageBox("PKCS #11 Error:", err.Error(), utils.MB_ICONERROR)
+			}
+		}
+		providers = append(providers, p11Agent)
+	}
+	providers = append(providers, upstreamAgents...)
+	if hvClient {
+		hvAgent := sshagent.NewHVAgent()
+		closers = append(closers, hvAgent.Close)
+		providers = append(providers, hvAgent)
+	}
+	return providers, func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}, nil
+}
+
 func initSystray(hv bool) (notify.Notifier, error) {
 	icon, err := notification.LoadIcon(1)
 	if err != nil {
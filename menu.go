@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	notification "github.com/hattya/go.notify/windows"
 	"github.com/buptczq/WinCryptSSHAgent/app"
 )
@@ -9,14 +11,24 @@ type Menu struct {
 	menu *notification.Menu
 	icon *notification.NotifyIcon
 	handlers map[app.AppId]func()
+	submenus map[string]*notification.Menu
 }
 
 func NewMenu(icon *notification.NotifyIcon)  *Menu{
-	return &Menu{icon.CreateMenu(),icon, make(map[app.AppId]func())}
+	return &Menu{icon.CreateMenu(),icon, make(map[app.AppId]func()), make(map[string]*notification.Menu)}
 }
 
 func (m *Menu)Register(id app.AppId, name string, handler func()){
-	m.menu.Item(name, uint(id))
+	menu := m.menu
+	if i := strings.Index(name, app.SUBMENU_SEP); i >= 0 {
+		parent := name[:i]
+		name = name[i+len(app.SUBMENU_SEP):]
+		if _, ok := m.submenus[parent]; !ok {
+			m.submenus[parent] = m.menu.Submenu(parent)
+		}
+		menu = m.submenus[parent]
+	}
+	menu.Item(name, uint(id))
 	m.handlers[id] = handler
 }
 
@@ -25,4 +37,3 @@ func (m *Menu)Handle(id app.AppId){
 		handler()
 	}
 }
-
@@ -0,0 +1,351 @@
+//go:build cgo
+// +build cgo
+
+// Package p11 offers the keys of PKCS #11 tokens as SSH signers.
+package p11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+// PKCS #11 3.0 values, not known to the wrapper yet
+const (
+	ckkECEdwards = 0x00000040
+	ckmEdDSA     = 0x00001057
+)
+
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// DigestInfo prefixes of CKM_RSA_PKCS signatures, from crypto/rsa
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Module is a loaded PKCS #11 module logged in to all of its tokens.
+type Module struct {
+	Path string
+
+	mu       sync.Mutex
+	ctx      *pkcs11.Ctx
+	sessions []pkcs11.SessionHandle
+	keys     []*Key
+}
+
+// Key is a private key object of a token.
+type Key struct {
+	Label string
+
+	module  *Module
+	session pkcs11.SessionHandle
+	object  pkcs11.ObjectHandle
+	keyType uint
+	pub     ssh.PublicKey
+}
+
+// Open loads a module, logs in to every token with pin and finds the RSA, ECDSA and Ed25519 keys.
+func Open(path, pin string) (*Module, error) {
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("p11: cannot load %s", path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+	m := &Module{Path: path, ctx: ctx}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	for _, slot := range slots {
+		// a token which is not initialized has neither a PIN nor keys
+		if info, err := ctx.GetTokenInfo(slot); err != nil || info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			continue
+		}
+		m.sessions = append(m.sessions, session)
+		if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			m.Close()
+			return nil, err
+		}
+		if err := m.findKeys(session); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if len(m.keys) == 0 {
+		m.Close()
+		return nil, errors.New("p11: no keys found")
+	}
+	return m, nil
+}
+
+func (m *Module) findObjects(session pkcs11.SessionHandle, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := m.ctx.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	defer m.ctx.FindObjectsFinal(session)
+	var objects []pkcs11.ObjectHandle
+	for {
+		found, _, err := m.ctx.FindObjects(session, 16)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return objects, nil
+		}
+		objects = append(objects, found...)
+	}
+}
+
+func (m *Module) findKeys(session pkcs11.SessionHandle) error {
+	objects, err := m.findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	})
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		attrs, err := m.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+		if err != nil || len(attrs) != 3 {
+			continue
+		}
+		key := &Key{
+			Label:   string(attrs[2].Value),
+			module:  m,
+			session: session,
+			object:  object,
+			keyType: ulong(attrs[0].Value),
+		}
+		pub, err := m.publicKey(session, object, key.keyType, attrs[1].Value)
+		if err != nil {
+			continue
+		}
+		if key.pub, err = ssh.NewPublicKey(pub); err != nil {
+			continue
+		}
+		m.keys = append(m.keys, key)
+	}
+	return nil
+}
+
+// publicKey reads the public key from the public key object with the same CKA_ID,
+// RSA private key objects usually carry their public values too.
+func (m *Module) publicKey(session pkcs11.SessionHandle, private pkcs11.ObjectHandle, keyType uint, id []byte) (crypto.PublicKey, error) {
+	object := private
+	if len(id) > 0 {
+		if objects, err := m.findObjects(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		}); err == nil && len(objects) > 0 {
+			object = objects[0]
+		}
+	}
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := m.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil || len(attrs) != 2 {
+			return nil, errors.New("p11: no RSA public key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC, ckkECEdwards:
+		if object == private {
+			return nil, errors.New("p11: no public key object")
+		}
+		attrs, err := m.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil || len(attrs) != 2 {
+			return nil, errors.New("p11: no EC public key")
+		}
+		return ecPublicKey(keyType, attrs[0].Value, attrs[1].Value)
+	}
+	return nil, errors.New("p11: unsupported key type")
+}
+
+func ecPublicKey(keyType uint, params, point []byte) (crypto.PublicKey, error) {
+	// CKA_EC_POINT is a DER OCTET STRING, some tokens return the raw point
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) > 0 {
+		raw = point
+	}
+	if keyType == ckkECEdwards {
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("p11: unsupported Edwards curve")
+		}
+		return ed25519.PublicKey(raw), nil
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, err
+	}
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidNamedCurveP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidNamedCurveP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidNamedCurveP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("p11: unsupported curve %v", oid)
+	}
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("p11: invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func ulong(b []byte) uint {
+	switch len(b) {
+	case 4:
+		return uint(binary.LittleEndian.Uint32(b))
+	case 8:
+		return uint(binary.LittleEndian.Uint64(b))
+	}
+	return ^uint(0)
+}
+
+// Keys returns the keys found when the module was opened.
+func (m *Module) Keys() []*Key {
+	return m.keys
+}
+
+// Close logs out, closes the sessions and unloads the module.
+func (m *Module) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx == nil {
+		return nil
+	}
+	for _, session := range m.sessions {
+		m.ctx.Logout(session)
+		m.ctx.CloseSession(session)
+	}
+	err := m.ctx.Finalize()
+	m.ctx.Destroy()
+	m.ctx = nil
+	m.sessions = nil
+	m.keys = nil
+	return err
+}
+
+func (k *Key) PublicKey() ssh.PublicKey {
+	return k.pub
+}
+
+func (k *Key) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.SignWithAlgorithm(rand, data, "")
+}
+
+func (k *Key) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	switch k.pub.Type() {
+	case ssh.KeyAlgoRSA:
+		var hash crypto.Hash
+		switch algorithm {
+		case "", ssh.SigAlgoRSA:
+			algorithm, hash = ssh.SigAlgoRSA, crypto.SHA1
+		case ssh.SigAlgoRSASHA2256:
+			hash = crypto.SHA256
+		case ssh.SigAlgoRSASHA2512:
+			hash = crypto.SHA512
+		default:
+			return nil, fmt.Errorf("ssh: unsupported signature algorithm %s", algorithm)
+		}
+		h := hash.New()
+		h.Write(data)
+		sig, err := k.sign(pkcs11.CKM_RSA_PKCS, append(hashPrefixes[hash], h.Sum(nil)...))
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Signature{Format: algorithm, Blob: sig}, nil
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		if algorithm != "" && algorithm != k.pub.Type() {
+			return nil, fmt.Errorf("ssh: unsupported signature algorithm %s", algorithm)
+		}
+		hash := crypto.SHA512
+		switch k.pub.Type() {
+		case ssh.KeyAlgoECDSA256:
+			hash = crypto.SHA256
+		case ssh.KeyAlgoECDSA384:
+			hash = crypto.SHA384
+		}
+		h := hash.New()
+		h.Write(data)
+		sig, err := k.sign(pkcs11.CKM_ECDSA, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		half := len(sig) / 2
+		return &ssh.Signature{
+			Format: k.pub.Type(),
+			Blob: ssh.Marshal(struct{ R, S *big.Int }{
+				new(big.Int).SetBytes(sig[:half]),
+				new(big.Int).SetBytes(sig[half:]),
+			}),
+		}, nil
+	case ssh.KeyAlgoED25519:
+		if algorithm != "" && algorithm != ssh.KeyAlgoED25519 {
+			return nil, fmt.Errorf("ssh: unsupported signature algorithm %s", algorithm)
+		}
+		sig, err := k.sign(ckmEdDSA, data)
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Signature{Format: ssh.KeyAlgoED25519, Blob: sig}, nil
+	}
+	return nil, errors.New("p11: unsupported key type")
+}
+
+func (k *Key) sign(mechanism uint, data []byte) ([]byte, error) {
+	k.module.mu.Lock()
+	defer k.module.mu.Unlock()
+
+	if k.module.ctx == nil {
+		return nil, errors.New("p11: module closed")
+	}
+	if err := k.module.ctx.SignInit(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, k.object); err != nil {
+		return nil, err
+	}
+	return k.module.ctx.Sign(k.session, data)
+}
@@ -0,0 +1,46 @@
+//go:build !cgo
+// +build !cgo
+
+// Package p11 offers the keys of PKCS #11 tokens as SSH signers.
+package p11
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Module is a loaded PKCS #11 module, it needs a build with cgo.
+type Module struct {
+	Path string
+}
+
+// Key is a private key object of a token.
+type Key struct {
+	Label string
+}
+
+func Open(path, pin string) (*Module, error) {
+	return nil, errors.New("p11: PKCS #11 support needs a build with cgo")
+}
+
+func (m *Module) Keys() []*Key {
+	return nil
+}
+
+func (m *Module) Close() error {
+	return nil
+}
+
+func (k *Key) PublicKey() ssh.PublicKey {
+	return nil
+}
+
+func (k *Key) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return nil, errors.New("p11: PKCS #11 support needs a build with cgo")
+}
+
+func (k *Key) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return k.Sign(rand, data)
+}
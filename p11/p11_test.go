@@ -0,0 +1,195 @@
+//go:build cgo
+// +build cgo
+
+package p11
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testSOPIN   = "87654321"
+	testUserPIN = "123456"
+)
+
+// softHSMModule returns the SoftHSM v2 module given by SOFTHSM2_MODULE or found at a usual place.
+func softHSMModule(t *testing.T) string {
+	if path := os.Getenv("SOFTHSM2_MODULE"); path != "" {
+		return path
+	}
+	for _, path := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		`C:\SoftHSM2\lib\softhsm2-x64.dll`,
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	t.Skip("SoftHSM v2 is not installed, set SOFTHSM2_MODULE to its module")
+	return ""
+}
+
+// initSoftHSM creates a token in a new SoftHSM store with an RSA and an ECDSA key.
+func initSoftHSM(t *testing.T, path string) {
+	dir, err := ioutil.TempDir("", "p11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old, set := os.LookupEnv("SOFTHSM2_CONF")
+	os.Setenv("SOFTHSM2_CONF", conf)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("SOFTHSM2_CONF", old)
+		} else {
+			os.Unsetenv("SOFTHSM2_CONF")
+		}
+	})
+
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		t.Fatalf("cannot load %s", path)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no slots: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], testSOPIN, "wincrypt"); err != nil {
+		t.Fatal(err)
+	}
+	// SoftHSM moves the initialized token to a new slot
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := ^uint(0)
+	for _, s := range slots {
+		if info, err := ctx.GetTokenInfo(s); err == nil && info.Flags&pkcs11.CKF_TOKEN_INITIALIZED != 0 {
+			slot = s
+		}
+	}
+	if slot == ^uint(0) {
+		t.Fatal("initialized token not found")
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.Login(session, pkcs11.CKU_SO, testSOPIN); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(session, testUserPIN); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(session)
+	if err := ctx.Login(session, pkcs11.CKU_USER, testUserPIN); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(session)
+
+	keyPair := func(label string, id byte, mechanism uint, public []*pkcs11.Attribute) {
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{id}),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		)
+		private := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{id}),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		}
+		if _, _, err := ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, public, private); err != nil {
+			t.Fatalf("%s: %v", label, err)
+		}
+	}
+	keyPair("rsa", 1, pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	})
+	params, _ := asn1.Marshal(oidNamedCurveP256)
+	keyPair("ecdsa", 2, pkcs11.CKM_EC_KEY_PAIR_GEN, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+	})
+}
+
+func TestSoftHSM(t *testing.T) {
+	path := softHSMModule(t)
+	initSoftHSM(t, path)
+
+	if _, err := Open(path, "000000"); err == nil {
+		t.Fatal("Open with a wrong PIN succeeded")
+	}
+
+	m, err := Open(path, testUserPIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	algorithms := map[string][]string{
+		"rsa":   {"", ssh.SigAlgoRSA, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSASHA2512},
+		"ecdsa": {"", ssh.KeyAlgoECDSA256},
+	}
+	keys := m.Keys()
+	if len(keys) != len(algorithms) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(algorithms))
+	}
+	data := []byte("session data")
+	for _, key := range keys {
+		want, ok := algorithms[key.Label]
+		if !ok {
+			t.Errorf("unexpected key %q", key.Label)
+			continue
+		}
+		for _, algorithm := range want {
+			sig, err := key.SignWithAlgorithm(rand.Reader, data, algorithm)
+			if err != nil {
+				t.Errorf("%s %q: %v", key.Label, algorithm, err)
+				continue
+			}
+			if err := key.PublicKey().Verify(data, sig); err != nil {
+				t.Errorf("%s %q: signature does not verify: %v", key.Label, algorithm, err)
+			}
+		}
+		if _, err := key.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoED25519); err == nil {
+			t.Errorf("%s: signing with %s succeeded", key.Label, ssh.KeyAlgoED25519)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys[0].Sign(rand.Reader, data); err == nil {
+		t.Error("a key of a closed module can still sign")
+	}
+}
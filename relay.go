@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/buptczq/WinCryptSSHAgent/agentproto"
+	"github.com/buptczq/WinCryptSSHAgent/app"
+	"github.com/buptczq/WinCryptSSHAgent/capi"
+	"github.com/buptczq/WinCryptSSHAgent/sshagent"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+)
+
+var relayMode = flag.Bool("relay", false, "Relay mode: serve the agent protocol on stdin and stdout, through the running agent or else an agent in this process, e.g. for socat EXEC: in WSL")
+
+// stdio is stdin and stdout as one connection.
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error {
+	os.Stdout.Close()
+	return os.Stdin.Close()
+}
+
+func runRelay() {
+	if err := relay(stdio{os.Stdin, os.Stdout}); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func relay(conn io.ReadWriteCloser) error {
+	timeout := time.Second
+	pipe, err := winio.DialPipe(app.NAMED_PIPE, &timeout)
+	if err == nil {
+		defer pipe.Close()
+		return agentproto.Relay(conn, pipe)
+	}
+	// a busy or slow agent is still the agent, a second one would ask for PINs again
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("relay: cannot connect to the running agent: %v", err)
+	}
+
+	// no agent is running, serve one for this connection
+	hvClient := false
+	if hvConn, err := utils.ConnectHyperV(); err == nil {
+		hvConn.Close()
+		hvClient = true
+	}
+	capi.SetDisablePINCache(*disablePINCache)
+	providers, closeProviders, err := newProviders(hvClient)
+	if err != nil {
+		return err
+	}
+	defer closeProviders()
+	server := &sshagent.Server{Agent: sshagent.NewComposedAgent(providers...)}
+	server.SSHAgentHandler(conn)
+	return nil
+}
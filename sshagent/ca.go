@@ -0,0 +1,173 @@
+package sshagent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+)
+
+// DefaultUserExtensions are the extensions ssh-keygen grants to user certificates by default.
+var DefaultUserExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+type CertRequest struct {
+	PublicKey       ssh.PublicKey
+	KeyId           string
+	CertType        uint32
+	Principals      []string
+	ValidAfter      time.Time
+	ValidBefore     time.Time
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+}
+
+// CertAuthority signs OpenSSH certificates with a key from the certificate store.
+type CertAuthority struct {
+	signer  ssh.Signer
+	comment string
+}
+
+// rsaSHA2Signer forces rsa-sha2-512 signatures, OpenSSH no longer accepts ssh-rsa CA signatures.
+type rsaSHA2Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s *rsaSHA2Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2512)
+}
+
+func NewCertAuthority(ag *CAPIAgent, selector string) (*CertAuthority, error) {
+	signer, comment, err := ag.Signer(selector)
+	if err != nil {
+		return nil, fmt.Errorf("ca: key <%s> %v", selector, err)
+	}
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+			signer = &rsaSHA2Signer{algorithmSigner}
+		}
+	}
+	return &CertAuthority{
+		signer:  signer,
+		comment: comment,
+	}, nil
+}
+
+func (s *CertAuthority) PublicKey() ssh.PublicKey {
+	return s.signer.PublicKey()
+}
+
+func (s *CertAuthority) Issue(req *CertRequest) (*ssh.Certificate, error) {
+	if req.PublicKey == nil {
+		return nil, errors.New("ca: missing public key")
+	}
+	if _, ok := req.PublicKey.(*ssh.Certificate); ok {
+		return nil, errors.New("ca: cannot sign a certificate")
+	}
+	if req.CertType != ssh.UserCert && req.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("ca: unknown certificate type %d", req.CertType)
+	}
+	if !req.ValidBefore.After(req.ValidAfter) {
+		return nil, errors.New("ca: invalid validity interval")
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	cert := &ssh.Certificate{
+		Key:             req.PublicKey,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        req.CertType,
+		KeyId:           req.KeyId,
+		ValidPrincipals: req.Principals,
+		ValidAfter:      uint64(req.ValidAfter.Unix()),
+		ValidBefore:     uint64(req.ValidBefore.Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: req.CriticalOptions,
+			Extensions:      req.Extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, s.signer); err != nil {
+		return nil, err
+	}
+
+	certType := "user"
+	if cert.CertType == ssh.HostCert {
+		certType = "host"
+	}
+	err := utils.Audit("ca: issued %s certificate serial=%d id=%q principals=%q valid=%s..%s key=%s ca=<%s> %s",
+		certType,
+		cert.Serial,
+		cert.KeyId,
+		strings.Join(cert.ValidPrincipals, ","),
+		req.ValidAfter.Format(time.RFC3339),
+		req.ValidBefore.Format(time.RFC3339),
+		ssh.FingerprintSHA256(cert.Key),
+		s.comment,
+		ssh.FingerprintSHA256(s.PublicKey()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ca: certificate not issued, the audit log cannot be written: %v", err)
+	}
+	return cert, nil
+}
+
+// AuthorizedKeysLine returns a cert-authority line for authorized_keys,
+// optionally restricted to the given principals.
+func (s *CertAuthority) AuthorizedKeysLine(principals []string) string {
+	line := "cert-authority"
+	if len(principals) > 0 {
+		line += fmt.Sprintf(`,principals="%s"`, strings.Join(principals, ","))
+	}
+	return line + " " + s.TrustedUserCAKeys()
+}
+
+// TrustedUserCAKeys returns the CA public key in the format of sshd TrustedUserCAKeys files.
+func (s *CertAuthority) TrustedUserCAKeys() string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.PublicKey())))
+	if s.comment != "" {
+		line += " " + s.comment
+	}
+	return line
+}
+
+// WriteCertificate saves cert next to the public key file it was issued for, as ssh-keygen does.
+func WriteCertificate(pubPath string, cert *ssh.Certificate) (string, error) {
+	path := strings.TrimSuffix(pubPath, ".pub") + "-cert.pub"
+	data := ssh.MarshalAuthorizedKey(cert)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// ParseCertOptions parses name[=value] pairs, one option each, so values may contain commas.
+func ParseCertOptions(list []string) map[string]string {
+	options := make(map[string]string)
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			options[kv[0]] = kv[1]
+		} else {
+			options[kv[0]] = ""
+		}
+	}
+	return options
+}
@@ -0,0 +1,18 @@
+package sshagent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCertOptions(t *testing.T) {
+	got := ParseCertOptions([]string{"force-command=ls -l", " source-address=10.0.0.0/8,192.168.0.0/16", "no-touch-required", ""})
+	want := map[string]string{
+		"force-command":     "ls -l",
+		"source-address":    "10.0.0.0/8,192.168.0.0/16",
+		"no-touch-required": "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCertOptions() = %v, want %v", got, want)
+	}
+}
@@ -2,26 +2,57 @@ package sshagent
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
 	"errors"
-	"fmt"
 	"github.com/buptczq/WinCryptSSHAgent/capi"
 	"github.com/buptczq/WinCryptSSHAgent/utils"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"os"
 	"sync"
+	"time"
 )
 
 type sshKey struct {
-	cert    *capi.Certificate
-	signer  ssh.Signer
-	comment string
+	cert     *capi.Certificate
+	signer   ssh.Signer
+	comment  string
+	certFile string
+	confirm  bool
+}
+
+// storePublicKey returns the public key of the store certificate, which is shared by
+// the OpenSSH certificate and x509v3 identities of the key.
+func (k *sshKey) storePublicKey() ssh.PublicKey {
+	if pub, err := ssh.NewPublicKey(k.cert.PublicKey); err == nil {
+		return pub
+	}
+	return k.signer.PublicKey()
 }
 
 type CAPIAgent struct {
-	mu   sync.Mutex
-	keys []*sshKey
+	// Sources are the stores and PFX files keys are loaded from, DefaultKeySource if empty.
+	Sources []*KeySource
+	// X509v3 additionally offers each certificate as an RFC 6187 identity.
+	X509v3 bool
+	// PersistCerts saves certificates attached with ssh-add to the user profile folder.
+	PersistCerts bool
+	// PersistHidden remembers keys hidden with ssh-add -d across restarts.
+	PersistHidden bool
+	// KeyStore receives private keys added with ssh-add whose comment starts with ImportCommentPrefix.
+	KeyStore KeyStore
+	// ImportKeys imports every private key added with ssh-add into KeyStore.
+	ImportKeys bool
+
+	mu       sync.Mutex
+	keys     []*sshKey
+	attached []*attachedCert
+	hidden   hiddenKeys
+	// loaded are certificates of the previous load, reused by the next one with their cached key handles
+	loaded map[string]*capi.Certificate
 }
 
 func (s *CAPIAgent) close() (err error) {
@@ -36,18 +67,109 @@ func (s *CAPIAgent) Close() (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.close()
+	err = s.close()
+	for _, source := range s.Sources {
+		source.Close()
+	}
+	return
+}
+
+func (s *CAPIAgent) expireCerts() {
+	now := time.Now()
+	attached := s.attached[:0]
+	for _, v := range s.attached {
+		if v.expire == nil || now.Before(*v.expire) {
+			attached = append(attached, v)
+		}
+	}
+	s.attached = attached
+}
+
+// loadCerts loads the keys of all sources, a source which fails is skipped.
+// The first error is returned if no source could be read.
+func (s *CAPIAgent) loadCerts() error {
+	s.expireCerts()
+	if len(s.Sources) == 0 {
+		s.Sources = []*KeySource{DefaultKeySource()}
+	}
+	s.keys = make([]*sshKey, 0)
+	var firstError error
+	read := false
+	for _, source := range s.Sources {
+		certs, err := source.certificates()
+		if err == errPasswordRequired {
+			go s.openSource(source)
+			continue
+		}
+		if err != nil {
+			println("KeySource", source.Name, "error:", err.Error())
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+		read = true
+		s.loadSourceCerts(source, certs)
+	}
+	for _, cert := range s.loaded {
+		cert.Free()
+	}
+	s.loaded = nil
+
+	keys := s.keys[:0]
+	for _, k := range s.keys {
+		if s.hiddenKeys().hidden(k.storePublicKey()) {
+			k.cert.Free()
+			continue
+		}
+		keys = append(keys, k)
+	}
+	s.keys = keys
+	if !read && firstError != nil {
+		return firstError
+	}
+	return nil
 }
 
-func (s *CAPIAgent) loadCerts() (err error) {
-	certs, err := capi.LoadUserCerts()
+// reload loads the keys again, e.g. for a card inserted since the last load.
+// Certificates which are still there keep their private key handles, so the handle
+// of a key is acquired once and not for each list of keys, unless signing with it failed.
+func (s *CAPIAgent) reload() error {
+	s.loaded = make(map[string]*capi.Certificate)
+	for _, k := range s.keys {
+		switch k.signer.(type) {
+		case *rsaSigner, *ecdsaSigner:
+			if _, ok := s.loaded[string(k.cert.Raw)]; !ok && !k.cert.KeyFailed() {
+				s.loaded[string(k.cert.Raw)] = k.cert
+				continue
+			}
+		}
+		k.cert.Free()
+	}
+	s.keys = nil
+	return s.loadCerts()
+}
+
+// openSource asks for the password of a PFX source without holding the agent lock,
+// the keys are reloaded once the file is open.
+func (s *CAPIAgent) openSource(source *KeySource) {
+	opened, err := source.openPFX()
 	if err != nil {
+		println("KeySource", source.Name, "error:", err.Error())
 		return
 	}
-	s.keys = make([]*sshKey, 0, len(certs))
+	if !opened {
+		return
+	}
+	s.mu.Lock()
+	s.close()
+	s.mu.Unlock()
+	notifyKeysChanged()
+}
 
+func (s *CAPIAgent) loadSourceCerts(source *KeySource, certs []*capi.Certificate) {
 	for _, cert := range certs {
-		if !FilterCertificateEKU(cert) {
+		if !source.accepts(cert) {
 			cert.Free()
 			continue
 		}
@@ -56,9 +178,14 @@ func (s *CAPIAgent) loadCerts() (err error) {
 			cert.Free()
 			continue
 		}
+		if loaded, ok := s.loaded[string(cert.Raw)]; ok {
+			delete(s.loaded, string(cert.Raw))
+			cert.Free()
+			cert = loaded
+		}
 		key := &sshKey{
 			cert:    cert,
-			comment: cert.Subject.CommonName,
+			comment: source.commentOf(cert),
 		}
 		switch pub.Type() {
 		case ssh.KeyAlgoRSA:
@@ -79,44 +206,47 @@ func (s *CAPIAgent) loadCerts() (err error) {
 		if keyWithCert, err := loadSSHCertificate(key); err == nil {
 			s.keys = append(s.keys, keyWithCert)
 		}
+		for _, attached := range s.attached {
+			if !bytes.Equal(attached.cert.Key.Marshal(), pub.Marshal()) {
+				continue
+			}
+			if keyWithCert, err := attachSSHCertificate(key, attached); err == nil {
+				s.keys = append(s.keys, keyWithCert)
+			}
+		}
+		if s.X509v3 {
+			if keyX509v3, err := loadX509v3Key(key); err == nil {
+				s.keys = append(s.keys, keyX509v3)
+			}
+		}
 	}
-	return
 }
 
-func (s *CAPIAgent) List() (keys []*agent.Key, err error) {
+func (s *CAPIAgent) hiddenKeys() *hiddenKeys {
+	s.hidden.persist = s.PersistHidden
+	return &s.hidden
+}
+
+func (s *CAPIAgent) Keys() ([]*ProviderKey, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.keys != nil {
-		s.close()
+	if err := s.reload(); err != nil {
+		return nil, err
 	}
-	err = s.loadCerts()
-	if err != nil {
-		return
-	}
-	var ids []*agent.Key
+	keys := make([]*ProviderKey, 0, len(s.keys))
 	for _, k := range s.keys {
-		pub := k.signer.PublicKey()
-		ids = append(ids, &agent.Key{
-			Format:  pub.Type(),
-			Blob:    pub.Marshal(),
-			Comment: k.comment})
+		keys = append(keys, &ProviderKey{
+			PublicKey: k.signer.PublicKey(),
+			Comment:   k.comment,
+			Kind:      "Certificate",
+			Confirm:   k.confirm,
+		})
 	}
-	return ids, nil
+	return keys, nil
 }
 
-func (s *CAPIAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	return s.SignWithFlags(key, data, 0)
-}
-
-func (s *CAPIAgent) signed(comment string) {
-	utils.Notify(
-		"Authenticated",
-		"Authentication Success by Certificate <"+comment+">",
-	)
-}
-
-func (s *CAPIAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+func (s *CAPIAgent) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -128,6 +258,61 @@ func (s *CAPIAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.Si
 		}
 	}
 
+	n := len(s.attached)
+	s.expireCerts()
+	if s.keys == nil || n != len(s.attached) {
+		if err := s.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	wanted := key.Marshal()
+	for _, k := range s.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			continue
+		}
+		// the signature algorithm of RFC 6187 identities is fixed by the key type
+		if _, ok := k.signer.(*x509v3Signer); ok {
+			algorithm = ""
+		}
+		return signWithAlgorithm(k.signer, data, algorithm)
+	}
+	return nil, errors.New("not found")
+}
+
+// Signer returns the signer of a store key selected by its common name,
+// certificate serial number or SHA256 fingerprint.
+func (s *CAPIAgent) Signer(selector string) (ssh.Signer, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		if err := s.loadCerts(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, k := range s.keys {
+		pub := k.signer.PublicKey()
+		if _, ok := pub.(*ssh.Certificate); ok {
+			continue
+		}
+		if _, ok := k.signer.(*x509v3Signer); ok {
+			continue
+		}
+		if k.comment == selector ||
+			k.cert.SerialNumber.String() == selector ||
+			ssh.FingerprintSHA256(pub) == selector {
+			return k.signer, k.comment, nil
+		}
+	}
+	return nil, "", errors.New("not found")
+}
+
+func (s *CAPIAgent) X509Certificate(key ssh.PublicKey) (*x509.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.keys == nil {
 		if err := s.loadCerts(); err != nil {
 			return nil, err
@@ -137,61 +322,251 @@ func (s *CAPIAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.Si
 	wanted := key.Marshal()
 	for _, k := range s.keys {
 		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
-			if flags == 0 {
-				sign, err := k.signer.Sign(rand.Reader, data)
-				if err == nil {
-					s.signed(k.comment)
-				}
-				return sign, err
-			} else {
-				if algorithmSigner, ok := k.signer.(ssh.AlgorithmSigner); !ok {
-					return nil, fmt.Errorf("agent: signature does not support non-default signature algorithm: %T", k.signer)
-				} else {
-					var algorithm string
-					switch flags {
-					case agent.SignatureFlagRsaSha256:
-						algorithm = ssh.SigAlgoRSASHA2256
-					case agent.SignatureFlagRsaSha512:
-						algorithm = ssh.SigAlgoRSASHA2512
-					default:
-						return nil, fmt.Errorf("agent: unsupported signature flags: %d", flags)
-					}
-					sign, err := algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
-					if err == nil {
-						s.signed(k.comment)
-					}
-					return sign, err
-				}
-			}
+			return k.cert.Certificate, nil
 		}
 	}
 	return nil, errors.New("not found")
 }
 
-func (*CAPIAgent) Add(key agent.AddedKey) error {
-	return fmt.Errorf("implement me")
+// AddKey attaches an OpenSSH certificate to the store key it was issued for,
+// or imports a private key into the key store.
+func (s *CAPIAgent) AddKey(key agent.AddedKey) error {
+	if ok, comment := s.imports(key); ok {
+		return s.importKey(key, comment)
+	}
+	if key.Certificate == nil || usablePrivateKey(key) {
+		return ErrKeyNotAccepted
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		if err := s.loadCerts(); err != nil {
+			return err
+		}
+	}
+
+	var target *sshKey
+	wanted := key.Certificate.Key.Marshal()
+	for _, k := range s.keys {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			target = k
+			break
+		}
+	}
+	if target == nil {
+		return errors.New("not found")
+	}
+
+	attached := &attachedCert{
+		cert:    key.Certificate,
+		comment: key.Comment,
+		confirm: key.ConfirmBeforeUse,
+	}
+	if attached.comment == "" {
+		attached.comment = key.Certificate.KeyId
+	}
+	if key.LifetimeSecs > 0 {
+		t := time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
+		attached.expire = &t
+	}
+
+	// a certificate with constraints lives for this session only
+	if s.PersistCerts && key.LifetimeSecs == 0 && !key.ConfirmBeforeUse {
+		if err := persistSSHCertificate(target, key.Certificate); err != nil {
+			return err
+		}
+	} else {
+		s.attached = append(s.attached, attached)
+	}
+	s.close()
+	utils.Notify(
+		"Certificate Attached",
+		"Certificate <"+attached.comment+"> has been attached to <"+target.comment+">",
+	)
+	return nil
+}
+
+func (s *CAPIAgent) imports(key agent.AddedKey) (bool, string) {
+	if s.KeyStore == nil {
+		return false, key.Comment
+	}
+	return importRequested(key, s.ImportKeys)
+}
+
+func (s *CAPIAgent) importKey(key agent.AddedKey, comment string) error {
+	if key.LifetimeSecs > 0 || key.ConfirmBeforeUse {
+		return errors.New("agent: constrained keys cannot be imported")
+	}
+	priv, ok := key.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("agent: unsupported key type")
+	}
+	switch priv.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return errors.New("agent: only RSA and ECDSA keys can be imported")
+	}
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		return err
+	}
+	if comment == "" {
+		comment = ssh.FingerprintSHA256(pub)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.KeyStore.Import(priv, comment); err != nil {
+		return err
+	}
+	if err := s.hiddenKeys().show(pub); err != nil {
+		return err
+	}
+	s.close()
+	utils.Notify(
+		"Key Imported",
+		"Key <"+comment+"> has been imported into the certificate store",
+	)
+	return nil
+}
+
+// RemoveKey detaches an OpenSSH certificate from its store key, or hides a store key.
+func (s *CAPIAgent) RemoveKey(key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		if err := s.loadCerts(); err != nil {
+			return err
+		}
+	}
+
+	wanted := key.Marshal()
+	found := false
+	attached := s.attached[:0]
+	for _, v := range s.attached {
+		if bytes.Equal(v.cert.Marshal(), wanted) {
+			found = true
+		} else {
+			attached = append(attached, v)
+		}
+	}
+	s.attached = attached
+	for _, k := range s.keys {
+		if k.certFile != "" && bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			if err := removeCertFile(k.certFile); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return s.hide(wanted)
+	}
+	s.close()
+	utils.Notify(
+		"Certificate Detached",
+		"Certificate has been detached from the certificate store key",
+	)
+	return nil
 }
 
-func (*CAPIAgent) Remove(key ssh.PublicKey) error {
-	return fmt.Errorf("implement me")
+// hide stops offering a store key with all its identities until it is restored from the menu.
+func (s *CAPIAgent) hide(wanted []byte) error {
+	for _, k := range s.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			continue
+		}
+		if err := s.hiddenKeys().hide(k.storePublicKey(), k.comment); err != nil {
+			return err
+		}
+		comment := k.comment
+		s.close()
+		utils.Notify(
+			"Key Hidden",
+			"Key <"+comment+"> has been hidden",
+		)
+		return nil
+	}
+	return errors.New("not found")
 }
 
-func (*CAPIAgent) RemoveAll() error {
-	return fmt.Errorf("implement me")
+// RemoveAllKeys hides all store keys.
+func (s *CAPIAgent) RemoveAllKeys() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for _, k := range s.keys {
+		// the store key comes before its other identities and names the hidden key
+		pub := k.storePublicKey()
+		if s.hiddenKeys().hidden(pub) {
+			continue
+		}
+		if err := s.hiddenKeys().hide(pub, k.comment); err != nil {
+			return err
+		}
+	}
+	s.close()
+	utils.Notify(
+		"Key Hidden",
+		"All certificate store keys have been hidden",
+	)
+	return nil
+}
+
+func (s *CAPIAgent) HiddenKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hiddenKeys().list()
 }
 
-func (*CAPIAgent) Lock(passphrase []byte) error {
-	return fmt.Errorf("implement me")
+func (s *CAPIAgent) RestoreHiddenKey(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shown, err := s.hiddenKeys().showFingerprint(fingerprint)
+	if err != nil || !shown {
+		return err
+	}
+	s.close()
+	notifyKeysChanged()
+	return nil
 }
 
-func (*CAPIAgent) Unlock(passphrase []byte) error {
-	return fmt.Errorf("implement me")
+func (s *CAPIAgent) RestoreHiddenKeys() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.hiddenKeys().restore(); err != nil {
+		return err
+	}
+	s.close()
+	notifyKeysChanged()
+	return nil
 }
 
-func (*CAPIAgent) Signers() ([]ssh.Signer, error) {
-	return nil, fmt.Errorf("implement me")
+// LockKeys frees the loaded keys, so smart card handles are not held while the agent is locked.
+func (s *CAPIAgent) LockKeys(passphrase []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.close()
 }
 
-func (s *CAPIAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
-	return nil, agent.ErrExtensionUnsupported
+// UnlockKeys asks again for the passwords of PFX files whose prompt was cancelled.
+func (s *CAPIAgent) UnlockKeys(passphrase []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, source := range s.Sources {
+		source.retry()
+	}
+	return nil
 }
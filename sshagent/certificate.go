@@ -1,20 +1,42 @@
 package sshagent
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-func loadCertFile(filename string) (*ssh.Certificate, error) {
+// attachedCert is an OpenSSH certificate added with ssh-add for a key in the certificate store.
+type attachedCert struct {
+	cert    *ssh.Certificate
+	comment string
+	expire  *time.Time
+	confirm bool
+}
+
+func certFilePath(filename string) (string, error) {
 	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, filename), nil
+}
+
+func loadCertFile(filename string) (*ssh.Certificate, error) {
+	path, err := certFilePath(filename)
 	if err != nil {
 		return nil, err
 	}
-	path := filepath.Join(home, filename)
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -44,6 +66,24 @@ func loadSSHCertificate(key *sshKey) (*sshKey, error) {
 	if err != nil {
 		return nil, err
 	}
+	keyWithCert, err := newCertKey(key, cert, cert.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	keyWithCert.certFile = filename
+	return keyWithCert, nil
+}
+
+func attachSSHCertificate(key *sshKey, attached *attachedCert) (*sshKey, error) {
+	keyWithCert, err := newCertKey(key, attached.cert, attached.comment)
+	if err != nil {
+		return nil, err
+	}
+	keyWithCert.confirm = attached.confirm
+	return keyWithCert, nil
+}
+
+func newCertKey(key *sshKey, cert *ssh.Certificate, comment string) (*sshKey, error) {
 	signer, err := ssh.NewCertSigner(cert, key.signer)
 	if err != nil {
 		return nil, err
@@ -55,6 +95,100 @@ func loadSSHCertificate(key *sshKey) (*sshKey, error) {
 	return &sshKey{
 		cert:    newX509Cert,
 		signer:  signer,
-		comment: cert.KeyId,
+		comment: comment,
 	}, nil
 }
+
+// persistedCertsFile lists the certificate files written by the agent, only these are deleted by ssh-add -d.
+const persistedCertsFile = "wincrypt-persisted-certs"
+
+func persistedCertFiles() map[string]bool {
+	files := make(map[string]bool)
+	path, err := certFilePath(persistedCertsFile)
+	if err != nil {
+		return files
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return files
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			files[name] = true
+		}
+	}
+	return files
+}
+
+func savePersistedCertFiles(files map[string]bool) error {
+	path, err := certFilePath(persistedCertsFile)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var data bytes.Buffer
+	for name := range files {
+		data.WriteString(name + "\r\n")
+	}
+	return ioutil.WriteFile(path, data.Bytes(), 0600)
+}
+
+// persistSSHCertificate saves cert with the public key override mechanism, so it is loaded after a restart.
+// A certificate file put there by the user is not overwritten.
+func persistSSHCertificate(key *sshKey, cert *ssh.Certificate) error {
+	filename := fmt.Sprintf("%s-cert.pub", key.cert.SerialNumber.String())
+	path, err := certFilePath(filename)
+	if err != nil {
+		return err
+	}
+	files := persistedCertFiles()
+	if _, err := os.Stat(path); err == nil && !files[filename] {
+		return errors.New("agent: " + filename + " exists and was not written by the agent")
+	}
+	if err := ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		return err
+	}
+	files[filename] = true
+	return savePersistedCertFiles(files)
+}
+
+// removeCertFile deletes a certificate file written by persistSSHCertificate.
+func removeCertFile(filename string) error {
+	files := persistedCertFiles()
+	if !files[filename] {
+		return errors.New("agent: " + filename + " was not written by the agent, remove it from the user profile folder")
+	}
+	path, err := certFilePath(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(files, filename)
+	return savePersistedCertFiles(files)
+}
+
+// usablePrivateKey reports whether an added key carries a private key matching its public key,
+// ssh-add of a certificate for a hardware key sends placeholder values instead.
+func usablePrivateKey(key agent.AddedKey) bool {
+	switch priv := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return priv.D != nil && priv.D.Sign() > 0 && priv.Validate() == nil
+	case *ecdsa.PrivateKey:
+		if priv.D == nil || priv.D.Sign() <= 0 || priv.D.Cmp(priv.Curve.Params().N) >= 0 {
+			return false
+		}
+		x, y := priv.Curve.ScalarBaseMult(priv.D.Bytes())
+		return x.Cmp(priv.X) == 0 && y.Cmp(priv.Y) == 0
+	case ed25519.PrivateKey:
+		return len(priv) == ed25519.PrivateKeySize &&
+			bytes.Equal(ed25519.NewKeyFromSeed(priv.Seed())[ed25519.SeedSize:], priv[ed25519.SeedSize:])
+	}
+	return key.PrivateKey != nil
+}
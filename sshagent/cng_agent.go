@@ -0,0 +1,134 @@
+package sshagent
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/buptczq/WinCryptSSHAgent/capi"
+	"golang.org/x/crypto/ssh"
+)
+
+type cngKey struct {
+	key     *capi.NCryptKey
+	signer  ssh.Signer
+	comment string
+}
+
+// CNGAgent serves persisted keys of key storage providers which have no certificate in the My store.
+type CNGAgent struct {
+	// Providers are short names from KeyProviders or names of key storage providers.
+	Providers []string
+
+	mu   sync.Mutex
+	keys []*cngKey
+}
+
+func (s *CNGAgent) close() (err error) {
+	for _, key := range s.keys {
+		err = key.key.Close()
+	}
+	s.keys = nil
+	return
+}
+
+func (s *CNGAgent) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.close()
+}
+
+// certificateKeys returns the public keys of the certificates in the My store, their keys are served by CAPIAgent.
+func certificateKeys() map[string]bool {
+	keys := make(map[string]bool)
+	certs, err := capi.LoadUserCerts()
+	if err != nil {
+		return keys
+	}
+	for _, cert := range certs {
+		if pub, err := ssh.NewPublicKey(cert.PublicKey); err == nil {
+			keys[string(pub.Marshal())] = true
+		}
+		cert.Free()
+	}
+	return keys
+}
+
+func (s *CNGAgent) loadKeys() error {
+	withCert := certificateKeys()
+	s.keys = make([]*cngKey, 0)
+	for _, name := range s.Providers {
+		providerName := name
+		if n, ok := KeyProviders[strings.ToLower(name)]; ok {
+			providerName = n
+		}
+		provider, err := capi.OpenKeyStorageProvider(providerName)
+		if err != nil {
+			println("CNGAgent error:", err.Error())
+			continue
+		}
+		names, err := provider.Keys()
+		if err != nil {
+			println("CNGAgent error:", err.Error())
+			provider.Close()
+			continue
+		}
+		for _, keyName := range names {
+			key, err := provider.OpenKey(keyName)
+			if err != nil {
+				continue
+			}
+			signer, err := ssh.NewSignerFromSigner(key)
+			if err != nil || withCert[string(signer.PublicKey().Marshal())] {
+				key.Close()
+				continue
+			}
+			s.keys = append(s.keys, &cngKey{
+				key:     key,
+				signer:  signer,
+				comment: keyName.Name,
+			})
+		}
+		provider.Close()
+	}
+	return nil
+}
+
+func (s *CNGAgent) Keys() ([]*ProviderKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.close()
+	if err := s.loadKeys(); err != nil {
+		return nil, err
+	}
+	keys := make([]*ProviderKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, &ProviderKey{
+			PublicKey: k.signer.PublicKey(),
+			Comment:   k.comment,
+		})
+	}
+	return keys, nil
+}
+
+func (s *CNGAgent) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		if err := s.loadKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	wanted := key.Marshal()
+	for _, k := range s.keys {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			return signWithAlgorithm(k.signer, data, algorithm)
+		}
+	}
+	return nil, errors.New("not found")
+}
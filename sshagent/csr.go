@@ -0,0 +1,354 @@
+package sshagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var (
+	oidSignatureSHA256WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureECDSAWithSHA256  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidSignatureEd25519          = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtKeyUsageServerAuth     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	oidExtKeyUsageClientAuth     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+	oidExtKeyUsageCodeSigning    = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}
+	oidExtKeyUsageEmail          = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}
+)
+
+var ekuNames = map[string]asn1.ObjectIdentifier{
+	"serverAuth":      oidExtKeyUsageServerAuth,
+	"clientAuth":      oidExtKeyUsageClientAuth,
+	"codeSigning":     oidExtKeyUsageCodeSigning,
+	"emailProtection": oidExtKeyUsageEmail,
+	"smartcardLogon":  oidExtKeyUsageSmartCardLogon,
+}
+
+type CSRRequest struct {
+	// Subject is an RFC 4514 distinguished name, e.g. `CN=alice,O=Example\, Inc.,C=US`.
+	Subject string
+	// SANs are DNS names, email addresses, IP addresses or URIs.
+	SANs []string
+	// EKUs are extended key usage names (clientAuth, serverAuth, ...) or dotted OIDs.
+	EKUs []string
+}
+
+type tbsCSR struct {
+	Version       int
+	Subject       asn1.RawValue
+	PublicKey     asn1.RawValue
+	RawAttributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+type csrRequest struct {
+	TBSCSR             asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+// CreateCertificateRequest builds a PEM encoded PKCS#10 request signed by signer.
+func CreateCertificateRequest(signer ssh.Signer, req *CSRRequest) ([]byte, error) {
+	cryptoPub, ok := signer.PublicKey().(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("csr: unsupported key type %s", signer.PublicKey().Type())
+	}
+	template := &x509.CertificateRequest{}
+	subject, err := parseDistinguishedName(req.Subject)
+	if err != nil {
+		return nil, err
+	}
+	template.Subject = subject
+	for _, v := range req.SANs {
+		if ip := net.ParseIP(v); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if strings.Contains(v, "://") {
+			u, err := url.Parse(v)
+			if err != nil {
+				return nil, err
+			}
+			template.URIs = append(template.URIs, u)
+		} else if strings.Contains(v, "@") {
+			template.EmailAddresses = append(template.EmailAddresses, v)
+		} else {
+			template.DNSNames = append(template.DNSNames, v)
+		}
+	}
+	if len(req.EKUs) > 0 {
+		ext, err := marshalEKUs(req.EKUs)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+
+	sigAlgo, err := csrSignatureAlgorithm(signer.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(cryptoPub.CryptoPublicKey())
+	if err != nil {
+		return nil, err
+	}
+	// x509 only signs with a crypto.Signer, so let it encode the subject and
+	// attributes with an ephemeral key and swap in the public key afterwards.
+	_, ephemeral, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	var csr csrRequest
+	if _, err := asn1.Unmarshal(der, &csr); err != nil {
+		return nil, err
+	}
+	var tbs tbsCSR
+	if _, err := asn1.Unmarshal(csr.TBSCSR.FullBytes, &tbs); err != nil {
+		return nil, err
+	}
+	tbs.PublicKey = asn1.RawValue{FullBytes: spki}
+	tbsBytes, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+	csr.TBSCSR = asn1.RawValue{FullBytes: tbsBytes}
+	csr.SignatureAlgorithm = sigAlgo
+
+	var sig *ssh.Signature
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, errors.New("csr: signer does not support rsa-sha2-256")
+		}
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, csr.TBSCSR.FullBytes, ssh.SigAlgoRSASHA2256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, csr.TBSCSR.FullBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signature, err := x509Signature(sig)
+	if err != nil {
+		return nil, err
+	}
+	csr.SignatureValue = asn1.BitString{Bytes: signature, BitLength: len(signature) * 8}
+	der, err = asn1.Marshal(csr)
+	if err != nil {
+		return nil, err
+	}
+	if parsed, err := x509.ParseCertificateRequest(der); err != nil {
+		return nil, err
+	} else if err := parsed.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("csr: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+func csrSignatureAlgorithm(pub ssh.PublicKey) (pkix.AlgorithmIdentifier, error) {
+	switch pub.Type() {
+	case ssh.KeyAlgoRSA:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA256WithRSA, Parameters: asn1.NullRawValue}, nil
+	case ssh.KeyAlgoECDSA256:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA256}, nil
+	case ssh.KeyAlgoECDSA384:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA384}, nil
+	case ssh.KeyAlgoECDSA521:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA512}, nil
+	case ssh.KeyAlgoED25519:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureEd25519}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("csr: unsupported key type %s", pub.Type())
+}
+
+// x509Signature converts an SSH signature blob to its X.509 encoding.
+func x509Signature(sig *ssh.Signature) ([]byte, error) {
+	switch sig.Format {
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var ecSig struct {
+			R, S *big.Int
+		}
+		if err := ssh.Unmarshal(sig.Blob, &ecSig); err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(ecSig)
+	case ssh.SigAlgoRSASHA2256, ssh.KeyAlgoED25519:
+		return sig.Blob, nil
+	}
+	return nil, fmt.Errorf("csr: unsupported signature format %s", sig.Format)
+}
+
+// parseEKU returns the OID of an extended key usage name (clientAuth, serverAuth, ...) or dotted OID.
+func parseEKU(v string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := ekuNames[v]; ok {
+		return oid, nil
+	}
+	var oid asn1.ObjectIdentifier
+	for _, n := range strings.Split(v, ".") {
+		var i int
+		if _, err := fmt.Sscanf(n, "%d", &i); err != nil {
+			return nil, fmt.Errorf("unknown extended key usage %s", v)
+		}
+		oid = append(oid, i)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("unknown extended key usage %s", v)
+	}
+	return oid, nil
+}
+
+func marshalEKUs(ekus []string) (pkix.Extension, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(ekus))
+	for _, v := range ekus {
+		oid, err := parseEKU(v)
+		if err != nil {
+			return pkix.Extension{}, fmt.Errorf("csr: %v", err)
+		}
+		oids = append(oids, oid)
+	}
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionExtendedKeyUsage, Value: value}, nil
+}
+
+// parseDistinguishedName parses an RFC 4514 distinguished name, e.g. CN=alice,O=Foo\, Inc.,C=US.
+func parseDistinguishedName(dn string) (pkix.Name, error) {
+	var name pkix.Name
+	attributes, err := splitDistinguishedName(dn)
+	if err != nil {
+		return name, err
+	}
+	for _, kv := range attributes {
+		value := kv[1]
+		switch strings.ToUpper(kv[0]) {
+		case "CN":
+			name.CommonName = value
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "C":
+			name.Country = append(name.Country, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		default:
+			return name, fmt.Errorf("csr: unsupported subject attribute %s", kv[0])
+		}
+	}
+	return name, nil
+}
+
+// splitDistinguishedName returns the type and unescaped value of each attribute of dn.
+// Attributes are separated by unescaped commas or plus signs, values may contain
+// backslash escapes of special characters or of hex pairs.
+func splitDistinguishedName(dn string) ([][2]string, error) {
+	var attributes [][2]string
+	var key, value []byte
+	inValue := false
+	// length of value without unescaped trailing spaces
+	end := 0
+	for i := 0; i < len(dn); i++ {
+		c := dn[i]
+		switch {
+		case c == ',' || c == '+':
+			if inValue {
+				attributes = append(attributes, [2]string{string(key), string(value[:end])})
+			} else if strings.TrimSpace(string(key)) != "" {
+				return nil, fmt.Errorf("csr: invalid subject %s", dn)
+			}
+			key, value, end, inValue = nil, nil, 0, false
+		case !inValue:
+			if c == '=' {
+				key = []byte(strings.TrimSpace(string(key)))
+				if len(key) == 0 {
+					return nil, fmt.Errorf("csr: invalid subject %s", dn)
+				}
+				inValue = true
+			} else {
+				key = append(key, c)
+			}
+		case c == '\\':
+			if i+1 < len(dn) && strings.IndexByte(`,+"\<>;= #`, dn[i+1]) >= 0 {
+				value = append(value, dn[i+1])
+				i++
+			} else if i+2 < len(dn) && isHexPair(dn[i+1:i+3]) {
+				b, _ := hex.DecodeString(dn[i+1 : i+3])
+				value = append(value, b[0])
+				i += 2
+			} else {
+				return nil, fmt.Errorf("csr: invalid escape in subject %s", dn)
+			}
+			end = len(value)
+		case c == ' ' && len(value) == 0:
+			// leading spaces are not part of the value
+		default:
+			value = append(value, c)
+			if c != ' ' {
+				end = len(value)
+			}
+		}
+	}
+	if inValue {
+		attributes = append(attributes, [2]string{string(key), string(value[:end])})
+	} else if strings.TrimSpace(string(key)) != "" {
+		return nil, fmt.Errorf("csr: invalid subject %s", dn)
+	}
+	return attributes, nil
+}
+
+func isHexPair(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// agentSigner signs through an agent, e.g. keyring keys of a running WinCryptSSHAgent.
+type agentSigner struct {
+	ag  agent.ExtendedAgent
+	pub ssh.PublicKey
+}
+
+func NewAgentSigner(ag agent.ExtendedAgent, pub ssh.PublicKey) ssh.AlgorithmSigner {
+	return &agentSigner{ag, pub}
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.ag.Sign(s.pub, data)
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case "", ssh.SigAlgoRSA:
+	case ssh.SigAlgoRSASHA2256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.SigAlgoRSASHA2512:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("agent: unsupported signature algorithm %s", algorithm)
+	}
+	return s.ag.SignWithFlags(s.pub, data, flags)
+}
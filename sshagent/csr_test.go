@@ -0,0 +1,105 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseDistinguishedName(t *testing.T) {
+	name, err := parseDistinguishedName(`CN=alice, O=Foo\, Inc.,OU=R\2BD+OU=\#ops\ ,C=US,L=  Zürich `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name.CommonName != "alice" ||
+		!reflect.DeepEqual(name.Organization, []string{"Foo, Inc."}) ||
+		!reflect.DeepEqual(name.OrganizationalUnit, []string{"R+D", "#ops "}) ||
+		!reflect.DeepEqual(name.Country, []string{"US"}) ||
+		!reflect.DeepEqual(name.Locality, []string{"Zürich"}) {
+		t.Errorf("parseDistinguishedName() = %+v", name)
+	}
+
+	for _, dn := range []string{"CN", "=alice", `CN=a\`, `CN=a\zz`, "CN=a,O", "E=alice@example.com"} {
+		if _, err := parseDistinguishedName(dn); err == nil {
+			t.Errorf("parseDistinguishedName(%q) succeeded", dn)
+		}
+	}
+}
+
+func TestCreateCertificateRequest(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []interface{}{rsaKey, ecKey, edKey} {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := CreateCertificateRequest(signer, &CSRRequest{
+			Subject: `CN=alice,O=Foo\, Inc.`,
+			SANs:    []string{"alice.example.com", "alice@example.com", "10.0.0.1"},
+			EKUs:    []string{"clientAuth", "1.3.6.1.4.1.311.20.2.2"},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", signer.PublicKey().Type(), err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			t.Fatalf("%s: not a PEM certificate request", signer.PublicKey().Type())
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("%s: %v", signer.PublicKey().Type(), err)
+		}
+
+		if csr.Subject.CommonName != "alice" || !reflect.DeepEqual(csr.Subject.Organization, []string{"Foo, Inc."}) {
+			t.Errorf("%s: subject = %v", signer.PublicKey().Type(), csr.Subject)
+		}
+		want, err := x509.MarshalPKIXPublicKey(signer.PublicKey().(ssh.CryptoPublicKey).CryptoPublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(csr.RawSubjectPublicKeyInfo, want) {
+			t.Errorf("%s: public key of the request is not the agent key", signer.PublicKey().Type())
+		}
+		if !reflect.DeepEqual(csr.DNSNames, []string{"alice.example.com"}) ||
+			!reflect.DeepEqual(csr.EmailAddresses, []string{"alice@example.com"}) ||
+			len(csr.IPAddresses) != 1 || csr.IPAddresses[0].String() != "10.0.0.1" {
+			t.Errorf("%s: subject alternative names = %v %v %v", signer.PublicKey().Type(), csr.DNSNames, csr.EmailAddresses, csr.IPAddresses)
+		}
+		var ekus []asn1.ObjectIdentifier
+		for _, ext := range csr.Extensions {
+			if ext.Id.Equal(oidExtensionExtendedKeyUsage) {
+				if _, err := asn1.Unmarshal(ext.Value, &ekus); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if len(ekus) != 2 || !ekus[0].Equal(oidExtKeyUsageClientAuth) || !ekus[1].Equal(oidExtKeyUsageSmartCardLogon) {
+			t.Errorf("%s: extended key usages = %v", signer.PublicKey().Type(), ekus)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package sshagent
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/asn1"
@@ -21,26 +22,66 @@ func (s *ecdsaSigner) PublicKey() ssh.PublicKey {
 
 func (s *ecdsaSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
 	pubkey := s.cert.PublicKey.(*ecdsa.PublicKey)
+	hash := ecHash(pubkey.Curve)
+	if sig, err := s.cert.SignHash(hashData(hash, data), hash); err != capi.ErrNotNCryptKey {
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Signature{
+			Format: s.pub.Type(),
+			Blob:   ecdsaSignatureBlob(sig),
+		}, nil
+	}
+
 	capiAlg := ecAlg(pubkey.Curve)
 	p7, err := capi.Sign(capiAlg, s.cert, data)
 	if err != nil || len(p7.Signers) < 1 {
 		return nil, err
 	}
 
-	type asn1Signature struct {
-		R, S *big.Int
-	}
-	asn1Sig := new(asn1Signature)
-	_, err = asn1.Unmarshal(p7.Signers[0].EncryptedDigest, asn1Sig)
+	blob, err := ecdsaASN1SignatureBlob(p7.Signers[0].EncryptedDigest)
 	if err != nil {
 		return nil, err
 	}
 	return &ssh.Signature{
 		Format: s.pub.Type(),
-		Blob:   ssh.Marshal(asn1Sig),
+		Blob:   blob,
 	}, nil
 }
 
+type asn1Signature struct {
+	R, S *big.Int
+}
+
+// ecdsaSignatureBlob converts an r || s signature of NCryptSignHash to the SSH signature blob.
+func ecdsaSignatureBlob(sig []byte) []byte {
+	half := len(sig) / 2
+	return ssh.Marshal(&asn1Signature{
+		R: new(big.Int).SetBytes(sig[:half]),
+		S: new(big.Int).SetBytes(sig[half:]),
+	})
+}
+
+// ecdsaASN1SignatureBlob converts an ASN.1 signature of CryptSignMessage to the SSH signature blob.
+func ecdsaASN1SignatureBlob(der []byte) ([]byte, error) {
+	sig := new(asn1Signature)
+	if _, err := asn1.Unmarshal(der, sig); err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(sig), nil
+}
+
+func ecHash(curve elliptic.Curve) crypto.Hash {
+	bitSize := curve.Params().BitSize
+	switch {
+	case bitSize <= 256:
+		return crypto.SHA256
+	case bitSize <= 384:
+		return crypto.SHA384
+	}
+	return crypto.SHA512
+}
+
 func ecAlg(curve elliptic.Curve) string {
 	bitSize := curve.Params().BitSize
 	switch {
@@ -0,0 +1,66 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rsSignature encodes a signature like NCryptSignHash, r and s padded to the size of the curve.
+func rsSignature(curve elliptic.Curve, r, s *big.Int) []byte {
+	size := (curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return sig
+}
+
+func TestECDSASignatureBlob(t *testing.T) {
+	data := []byte("data")
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ssh.NewPublicKey(&priv.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		// sign until r or s is shorter than the curve, so the padding is stripped at least once
+		padded := false
+		for i := 0; i < 10 || !padded && i < 2000; i++ {
+			r, s, err := ecdsa.Sign(rand.Reader, priv, hashData(ecHash(curve), data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			padded = padded || len(r.Bytes()) < size || len(s.Bytes()) < size
+
+			der, err := asn1.Marshal(asn1Signature{r, s})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := ecdsaASN1SignatureBlob(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ecdsaSignatureBlob(rsSignature(curve, r, s))
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: blob of r || s = %x, blob of the ASN.1 signature = %x", pub.Type(), got, want)
+			}
+			if err := pub.Verify(data, &ssh.Signature{Format: pub.Type(), Blob: got}); err != nil {
+				t.Fatalf("%s: %v", pub.Type(), err)
+			}
+		}
+		if !padded {
+			t.Errorf("%s: no signature with padding", pub.Type())
+		}
+	}
+}
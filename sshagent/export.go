@@ -0,0 +1,217 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"strings"
+)
+
+const (
+	ExportAuthorizedKeys = "authorized_keys"
+	ExportRFC4716        = "rfc4716"
+	ExportPKIX           = "pkix"
+	ExportSHA256         = "sha256"
+	ExportMD5            = "md5"
+	ExportRandomArt      = "randomart"
+	ExportX509           = "x509"
+	ExportThumbprint     = "thumbprint"
+)
+
+var ExportFormats = []string{
+	ExportAuthorizedKeys,
+	ExportRFC4716,
+	ExportPKIX,
+	ExportSHA256,
+	ExportMD5,
+	ExportRandomArt,
+	ExportX509,
+	ExportThumbprint,
+}
+
+// CertificateProvider is implemented by agents serving keys backed by X.509 certificates.
+type CertificateProvider interface {
+	X509Certificate(key ssh.PublicKey) (*x509.Certificate, error)
+}
+
+// ExportPublicKey formats key in the given export format, options only apply to authorized_keys lines.
+func ExportPublicKey(ag agent.Agent, key *agent.Key, format, options string) (string, error) {
+	pub, err := ssh.ParsePublicKey(key.Blob)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case ExportAuthorizedKeys:
+		line := key.String()
+		if options != "" {
+			line = options + " " + line
+		}
+		return line, nil
+	case ExportRFC4716:
+		return rfc4716(pub, key.Comment), nil
+	case ExportPKIX:
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			pub = cert.Key
+		}
+		cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			return "", fmt.Errorf("export: unsupported key type %s", pub.Type())
+		}
+		der, err := x509.MarshalPKIXPublicKey(cryptoPub.CryptoPublicKey())
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))), nil
+	case ExportSHA256:
+		return fmt.Sprintf("%d %s %s (%s)", keyBits(pub), ssh.FingerprintSHA256(pub), key.Comment, keyTypeName(pub)), nil
+	case ExportMD5:
+		return fmt.Sprintf("%d MD5:%s %s (%s)", keyBits(pub), ssh.FingerprintLegacyMD5(pub), key.Comment, keyTypeName(pub)), nil
+	case ExportRandomArt:
+		return randomArt(pub), nil
+	case ExportX509, ExportThumbprint:
+		provider, ok := ag.(CertificateProvider)
+		if !ok {
+			return "", fmt.Errorf("export: key <%s> has no X.509 certificate", key.Comment)
+		}
+		cert, err := provider.X509Certificate(pub)
+		if err != nil {
+			return "", err
+		}
+		if format == ExportThumbprint {
+			sum := sha1.Sum(cert.Raw)
+			return strings.ToUpper(hex.EncodeToString(sum[:])) + " " + key.Comment, nil
+		}
+		return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))), nil
+	}
+	return "", fmt.Errorf("export: unknown format %s", format)
+}
+
+func rfc4716(pub ssh.PublicKey, comment string) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("---- BEGIN SSH2 PUBLIC KEY ----\n")
+	if comment != "" {
+		// header lines must not be longer than 72 bytes
+		header := fmt.Sprintf("Comment: \"%s\"", strings.ReplaceAll(comment, "\"", "\\\""))
+		for len(header) > 72 {
+			buf.WriteString(header[:71] + "\\\n")
+			header = header[71:]
+		}
+		buf.WriteString(header + "\n")
+	}
+	b64 := base64.StdEncoding.EncodeToString(pub.Marshal())
+	for len(b64) > 70 {
+		buf.WriteString(b64[:70] + "\n")
+		b64 = b64[70:]
+	}
+	buf.WriteString(b64 + "\n")
+	buf.WriteString("---- END SSH2 PUBLIC KEY ----")
+	return buf.String()
+}
+
+func keyBits(pub ssh.PublicKey) int {
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	}
+	return 256
+}
+
+func keyTypeName(pub ssh.PublicKey) string {
+	name := ""
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+		name = "-CERT"
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoRSA:
+		return "RSA" + name
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return "ECDSA" + name
+	case ssh.KeyAlgoED25519:
+		return "ED25519" + name
+	}
+	return strings.ToUpper(pub.Type()) + name
+}
+
+// randomArt draws the OpenSSH fingerprint visualization (drunken bishop) of the SHA256 fingerprint.
+func randomArt(pub ssh.PublicKey) string {
+	const (
+		width  = 17
+		height = 9
+		chars  = " .o+=*BOX@%&#/^SE"
+	)
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	var field [width][height]int
+	x, y := width/2, height/2
+	sum := sha256.Sum256(pub.Marshal())
+	for _, b := range sum {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			if x < 0 {
+				x = 0
+			} else if x > width-1 {
+				x = width - 1
+			}
+			if y < 0 {
+				y = 0
+			} else if y > height-1 {
+				y = height - 1
+			}
+			if field[x][y] < len(chars)-3 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[width/2][height/2] = len(chars) - 2
+	field[x][y] = len(chars) - 1
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(artTitle(fmt.Sprintf("[%s %d]", keyTypeName(pub), keyBits(pub)), width))
+	for j := 0; j < height; j++ {
+		buf.WriteString("|")
+		for i := 0; i < width; i++ {
+			buf.WriteByte(chars[field[i][j]])
+		}
+		buf.WriteString("|\n")
+	}
+	buf.WriteString(strings.TrimSuffix(artTitle("[SHA256]", width), "\n"))
+	return buf.String()
+}
+
+func artTitle(title string, width int) string {
+	if len(title) > width {
+		title = title[:width]
+	}
+	left := (width - len(title)) / 2
+	return "+" + strings.Repeat("-", left) + title + strings.Repeat("-", width-len(title)-left) + "+\n"
+}
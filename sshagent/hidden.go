@@ -0,0 +1,127 @@
+package sshagent
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const hiddenKeysFile = "wincrypt-hidden-keys"
+
+// KeyHider is implemented by agents whose keys can be hidden with ssh-add -d and restored later.
+// HiddenKeys returns "<comment> <SHA256 fingerprint>" lines, RestoreHiddenKey takes the fingerprint.
+type KeyHider interface {
+	HiddenKeys() []string
+	RestoreHiddenKey(fingerprint string) error
+	RestoreHiddenKeys() error
+}
+
+// hiddenKeys is a set of SHA256 fingerprints which are not offered, optionally saved to the user profile folder.
+type hiddenKeys struct {
+	persist bool
+	keys    map[string]string
+}
+
+func (h *hiddenKeys) load() {
+	if h.keys != nil {
+		return
+	}
+	h.keys = make(map[string]string)
+	if !h.persist {
+		return
+	}
+	path, err := certFilePath(hiddenKeysFile)
+	if err != nil {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if kv[0] == "" {
+			continue
+		}
+		if len(kv) == 2 {
+			h.keys[kv[0]] = kv[1]
+		} else {
+			h.keys[kv[0]] = ""
+		}
+	}
+}
+
+func (h *hiddenKeys) save() error {
+	if !h.persist {
+		return nil
+	}
+	path, err := certFilePath(hiddenKeysFile)
+	if err != nil {
+		return err
+	}
+	if len(h.keys) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for fp, comment := range h.keys {
+		if _, err := file.WriteString(fp + " " + comment + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hiddenKeys) hide(pub ssh.PublicKey, comment string) error {
+	h.load()
+	h.keys[ssh.FingerprintSHA256(pub)] = comment
+	return h.save()
+}
+
+func (h *hiddenKeys) show(pub ssh.PublicKey) error {
+	_, err := h.showFingerprint(ssh.FingerprintSHA256(pub))
+	return err
+}
+
+// showFingerprint restores one key and reports whether it was hidden.
+func (h *hiddenKeys) showFingerprint(fp string) (bool, error) {
+	h.load()
+	if _, ok := h.keys[fp]; !ok {
+		return false, nil
+	}
+	delete(h.keys, fp)
+	return true, h.save()
+}
+
+func (h *hiddenKeys) hidden(pub ssh.PublicKey) bool {
+	h.load()
+	_, ok := h.keys[ssh.FingerprintSHA256(pub)]
+	return ok
+}
+
+func (h *hiddenKeys) list() []string {
+	h.load()
+	list := make([]string, 0, len(h.keys))
+	for fp, comment := range h.keys {
+		list = append(list, comment+" "+fp)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (h *hiddenKeys) restore() error {
+	h.load()
+	h.keys = make(map[string]string)
+	return h.save()
+}
@@ -0,0 +1,128 @@
+package sshagent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	DefaultHostTimeout = 5 * time.Second
+	// DefaultHostSignTimeout leaves time for the PIN and confirmation prompts on the host.
+	DefaultHostSignTimeout = 5 * time.Minute
+	DefaultHostKeysTTL     = 2 * time.Second
+
+	hostPoolSize   = 4
+	hostMinBackoff = time.Second
+	hostMaxBackoff = 30 * time.Second
+)
+
+type hostConn struct {
+	net.Conn
+	client agent.ExtendedAgent
+	// err is the first read or write error, failure replies of the host leave the connection usable.
+	err error
+	// replied is set once a reply of the current request is read
+	replied bool
+}
+
+func (c *hostConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.replied = true
+	}
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *hostConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// closedByHost reports whether a pooled connection had been closed by the host before the request,
+// so the host never got it. A request which timed out may still be handled by the host.
+func (c *hostConn) closedByHost() bool {
+	if c.err == nil || c.replied {
+		return false
+	}
+	if err, ok := c.err.(net.Error); ok && err.Timeout() {
+		return false
+	}
+	return true
+}
+
+// hostPool keeps idle connections to the agent of the Hyper-V host,
+// after a failed dial the host is not dialed again until the backoff has passed.
+type hostPool struct {
+	mu      sync.Mutex
+	idle    []*hostConn
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// get returns an idle connection unless fresh is set, reused reports whether it was used before.
+func (p *hostPool) get(fresh bool) (conn *hostConn, reused bool, err error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 && !fresh {
+		conn = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return conn, true, nil
+	}
+	if wait := time.Until(p.retryAt); wait > 0 {
+		p.mu.Unlock()
+		return nil, false, fmt.Errorf("agent: Hyper-V host agent is unreachable, retrying in %v", wait.Round(time.Second))
+	}
+	p.mu.Unlock()
+
+	c, err := utils.ConnectHyperV()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.backoff *= 2
+		if p.backoff < hostMinBackoff {
+			p.backoff = hostMinBackoff
+		}
+		if p.backoff > hostMaxBackoff {
+			p.backoff = hostMaxBackoff
+		}
+		p.retryAt = time.Now().Add(p.backoff)
+		return nil, false, fmt.Errorf("agent: Hyper-V host agent is unreachable: %v", err)
+	}
+	p.backoff = 0
+	conn = &hostConn{Conn: c}
+	conn.client = agent.NewClient(conn)
+	return conn, false, nil
+}
+
+func (p *hostPool) put(conn *hostConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= hostPoolSize {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, conn)
+}
+
+func (p *hostPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+}
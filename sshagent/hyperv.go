@@ -2,58 +2,225 @@ package sshagent
 
 import (
 	"fmt"
-	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"sync"
+	"time"
+
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// HVAgent forwards every request to the agent running on the Hyper-V host.
+// It is an agent.ExtendedAgent and also serves the host keys as a KeyProvider.
+//
+// Connections to the host are kept open and reused, and the host key list is
+// reused for KeysTTL, so tools listing keys repeatedly do not wait for the host each time.
 type HVAgent struct {
+	// Timeout limits requests to the host, DefaultHostTimeout if zero.
+	Timeout time.Duration
+	// SignTimeout limits sign and extension requests, which may wait for prompts on the host,
+	// DefaultHostSignTimeout if zero.
+	SignTimeout time.Duration
+	// KeysTTL is how long the host key list is reused, DefaultHostKeysTTL if zero.
+	KeysTTL time.Duration
+
+	pool   hostPool
+	mu     sync.Mutex
+	keys   []*agent.Key
+	keysAt time.Time
 }
 
 func NewHVAgent() *HVAgent {
 	return &HVAgent{}
 }
 
+func (s *HVAgent) Close() error {
+	s.pool.close()
+	return nil
+}
+
+func (s *HVAgent) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultHostTimeout
+}
+
+func (s *HVAgent) signTimeout() time.Duration {
+	if s.SignTimeout > 0 {
+		return s.SignTimeout
+	}
+	return DefaultHostSignTimeout
+}
+
+func (s *HVAgent) keysTTL() time.Duration {
+	if s.KeysTTL > 0 {
+		return s.KeysTTL
+	}
+	return DefaultHostKeysTTL
+}
+
+// do sends a request to the host, which must be answered within timeout. Requests which may be
+// sent twice use pooled connections and are sent again only if the host had closed the pooled
+// connection before the request, the others use a new connection.
+// A failure reply of the host is returned as it is and keeps the connection in the pool.
+func (s *HVAgent) do(idempotent bool, timeout time.Duration, f func(proxy agent.ExtendedAgent) error) error {
+	for {
+		conn, reused, err := s.pool.get(!idempotent)
+		if err != nil {
+			return err
+		}
+		conn.replied = false
+		conn.SetDeadline(time.Now().Add(timeout))
+		err = f(conn.client)
+		if conn.err == nil {
+			conn.SetDeadline(time.Time{})
+			s.pool.put(conn)
+			return err
+		}
+		conn.Close()
+		if !reused || !conn.closedByHost() {
+			return err
+		}
+	}
+}
+
+// changed forgets the host key list after a request which may change it.
+func (s *HVAgent) changed() {
+	s.mu.Lock()
+	s.keys = nil
+	s.mu.Unlock()
+}
+
 func (s *HVAgent) List() ([]*agent.Key, error) {
-	conn, err := utils.ConnectHyperV()
+	s.mu.Lock()
+	if s.keys != nil && time.Since(s.keysAt) < s.keysTTL() {
+		keys := s.keys
+		s.mu.Unlock()
+		return keys, nil
+	}
+	s.mu.Unlock()
+
+	var keys []*agent.Key
+	err := s.do(true, s.timeout(), func(proxy agent.ExtendedAgent) (err error) {
+		keys, err = proxy.List()
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	proxy := agent.NewClient(conn)
-	return proxy.List()
+	if keys == nil {
+		keys = []*agent.Key{}
+	}
+	s.mu.Lock()
+	s.keys, s.keysAt = keys, time.Now()
+	s.mu.Unlock()
+	return keys, nil
 }
 
 func (s *HVAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	conn, err := utils.ConnectHyperV()
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	proxy := agent.NewClient(conn)
-	return proxy.Sign(key, data)
+	return s.SignWithFlags(key, data, 0)
+}
+
+func (s *HVAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (sig *ssh.Signature, err error) {
+	err = s.do(true, s.signTimeout(), func(proxy agent.ExtendedAgent) error {
+		sig, err = proxy.SignWithFlags(key, data, flags)
+		return err
+	})
+	return
 }
 
+// Add, Remove, RemoveAll, Lock and Unlock are refused by hosts started with -hv-readonly.
 func (s *HVAgent) Add(key agent.AddedKey) error {
-	return fmt.Errorf("implement me")
+	defer s.changed()
+	return s.do(false, s.timeout(), func(proxy agent.ExtendedAgent) error {
+		return proxy.Add(key)
+	})
 }
 
 func (s *HVAgent) Remove(key ssh.PublicKey) error {
-	return fmt.Errorf("implement me")
+	defer s.changed()
+	return s.do(false, s.timeout(), func(proxy agent.ExtendedAgent) error {
+		return proxy.Remove(key)
+	})
 }
 
 func (s *HVAgent) RemoveAll() error {
-	return fmt.Errorf("implement me")
+	defer s.changed()
+	return s.do(false, s.timeout(), func(proxy agent.ExtendedAgent) error {
+		return proxy.RemoveAll()
+	})
 }
 
 func (s *HVAgent) Lock(passphrase []byte) error {
-	return fmt.Errorf("implement me")
+	defer s.changed()
+	return s.do(false, s.timeout(), func(proxy agent.ExtendedAgent) error {
+		return proxy.Lock(passphrase)
+	})
 }
 
 func (s *HVAgent) Unlock(passphrase []byte) error {
-	return fmt.Errorf("implement me")
+	defer s.changed()
+	return s.do(false, s.timeout(), func(proxy agent.ExtendedAgent) error {
+		return proxy.Unlock(passphrase)
+	})
 }
 
 func (s *HVAgent) Signers() ([]ssh.Signer, error) {
-	return nil, fmt.Errorf("implement me")
+	return nil, fmt.Errorf("agent: signers of the Hyper-V host are not available")
+}
+
+func (s *HVAgent) Extension(extensionType string, contents []byte) (resp []byte, err error) {
+	err = s.do(false, s.signTimeout(), func(proxy agent.ExtendedAgent) error {
+		resp, err = proxy.Extension(extensionType, contents)
+		return err
+	})
+	return
+}
+
+// Keys lists the host keys with "[host]" in front of the comment, an unreachable host has no keys.
+func (s *HVAgent) Keys() ([]*ProviderKey, error) {
+	ids, err := s.List()
+	if err != nil {
+		println(err.Error())
+		return nil, nil
+	}
+	keys := make([]*ProviderKey, 0, len(ids))
+	for _, id := range ids {
+		pub, err := ssh.ParsePublicKey(id.Blob)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, &ProviderKey{
+			PublicKey: pub,
+			Comment:   "[host] " + id.Comment,
+			Kind:      "Host Key",
+		})
+	}
+	return keys, nil
+}
+
+func (s *HVAgent) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, signatureFlags(algorithm))
+}
+
+func (s *HVAgent) AddKey(key agent.AddedKey) error {
+	return s.Add(key)
+}
+
+func (s *HVAgent) RemoveKey(key ssh.PublicKey) error {
+	return s.Remove(key)
+}
+
+func (s *HVAgent) RemoveAllKeys() error {
+	return s.RemoveAll()
+}
+
+// LockKeys locks the host agent too, a host started with -hv-readonly refuses it
+// and only the guest is locked.
+func (s *HVAgent) LockKeys(passphrase []byte) error {
+	return s.Lock(passphrase)
+}
+
+func (s *HVAgent) UnlockKeys(passphrase []byte) error {
+	return s.Unlock(passphrase)
 }
@@ -0,0 +1,107 @@
+package sshagent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/capi"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyProviders maps short names of key storage providers to their CNG names.
+var KeyProviders = map[string]string{
+	"software":  capi.MS_KEY_STORAGE_PROVIDER,
+	"tpm":       capi.MS_PLATFORM_CRYPTO_PROVIDER,
+	"smartcard": capi.MS_SMART_CARD_KEY_STORAGE_PROVIDER,
+}
+
+// KeyRequest describes a key generated in a key storage provider.
+type KeyRequest struct {
+	// Provider is a short name from KeyProviders or the name of a key storage provider.
+	Provider string
+	// Type is rsa or ecdsa.
+	Type string
+	// Bits is the RSA modulus size or the ECDSA curve size, the default is 2048 or 256.
+	Bits       int
+	CommonName string
+	Validity   time.Duration
+}
+
+func (req *KeyRequest) algorithm() (string, error) {
+	switch strings.ToLower(req.Type) {
+	case "rsa":
+		if req.Bits == 0 {
+			req.Bits = 2048
+		}
+		if req.Bits < 2048 {
+			return "", errors.New("keygen: RSA keys must be at least 2048 bits")
+		}
+		return capi.NCRYPT_RSA_ALGORITHM, nil
+	case "ecdsa":
+		switch req.Bits {
+		case 0, 256:
+			req.Bits = 256
+			return capi.NCRYPT_ECDSA_P256_ALGORITHM, nil
+		case 384:
+			return capi.NCRYPT_ECDSA_P384_ALGORITHM, nil
+		case 521:
+			return capi.NCRYPT_ECDSA_P521_ALGORITHM, nil
+		}
+		return "", errors.New("keygen: ECDSA keys must be 256, 384 or 521 bits")
+	}
+	return "", errors.New("keygen: unsupported key type " + req.Type)
+}
+
+// GenerateKey creates a key in a key storage provider and a self-signed client authentication
+// certificate for it in the user's My store, so it is served like any other certificate.
+func GenerateKey(req *KeyRequest) (ssh.PublicKey, error) {
+	if req.CommonName == "" {
+		return nil, errors.New("keygen: missing common name")
+	}
+	algorithm, err := req.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	providerName := req.Provider
+	if name, ok := KeyProviders[strings.ToLower(providerName)]; ok {
+		providerName = name
+	}
+	if providerName == "" {
+		providerName = capi.MS_KEY_STORAGE_PROVIDER
+	}
+	if req.Validity == 0 {
+		req.Validity = importedCertValidity
+	}
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	provider, err := capi.OpenKeyStorageProvider(providerName)
+	if err != nil {
+		return nil, err
+	}
+	defer provider.Close()
+	key, err := provider.CreateKey("WinCryptSSHAgent-"+hex.EncodeToString(random), algorithm, req.Bits)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+
+	// without its certificate the key would never be used, so it is not kept
+	der, err := selfSignedCertificate(key, req.CommonName, req.Validity)
+	if err == nil {
+		err = capi.AddUserCertificate(der, key)
+	}
+	if err != nil {
+		if derr := key.Delete(); derr != nil {
+			println("keygen: cannot delete the new key:", derr.Error())
+		}
+		return nil, err
+	}
+	notifyKeysChanged()
+	return ssh.NewPublicKey(key.Public())
+}
@@ -3,41 +3,180 @@ package sshagent
 import (
 	"bytes"
 	"encoding/base64"
+	"sync"
+
 	"github.com/buptczq/WinCryptSSHAgent/utils"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// KeyRingAgent keeps keys added with ssh-add in memory, and keys of PuTTY private key files
+// added with Pageant, which stay encrypted until they are used for the first time.
 type KeyRingAgent struct {
 	ag agent.ExtendedAgent
+
+	mu      sync.Mutex
+	confirm map[string]bool
+	pending []*ppkKey
+
+	// decrypting is held while a passphrase is asked for
+	decrypting sync.Mutex
 }
 
 func NewKeyRingAgent() *KeyRingAgent {
 	return &KeyRingAgent{
-		ag: agent.NewKeyring().(agent.ExtendedAgent),
+		ag:      agent.NewKeyring().(agent.ExtendedAgent),
+		confirm: make(map[string]bool),
 	}
 }
 
-func (s *KeyRingAgent) List() ([]*agent.Key, error) {
-	return s.ag.List()
+func (s *KeyRingAgent) Keys() ([]*ProviderKey, error) {
+	ids, err := s.ag.List()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*ProviderKey, 0, len(ids))
+	for _, id := range ids {
+		pub, err := ssh.ParsePublicKey(id.Blob)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, &ProviderKey{
+			PublicKey: pub,
+			Comment:   id.Comment,
+			Confirm:   s.confirm[string(id.Blob)],
+		})
+	}
+	for _, k := range s.pending {
+		keys = append(keys, &ProviderKey{
+			PublicKey: k.publicKey,
+			Comment:   k.comment,
+			Encrypted: true,
+		})
+	}
+	return keys, nil
 }
 
-func (s *KeyRingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	return s.SignWithFlags(key, data, 0)
+func (s *KeyRingAgent) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
+	if err := s.decryptPending(key); err != nil {
+		return nil, err
+	}
+	return s.ag.SignWithFlags(key, data, signatureFlags(algorithm))
 }
 
-func (s *KeyRingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	comment := s.findKeyComment(key)
-	sig, err := s.ag.SignWithFlags(key, data, flags)
-	if err == nil {
-		s.signed(comment)
+// findPending returns the index of an encrypted key, or -1. s.mu must be held.
+func (s *KeyRingAgent) findPending(key ssh.PublicKey) int {
+	wanted := key.Marshal()
+	for i, k := range s.pending {
+		if bytes.Equal(k.public, wanted) {
+			return i
+		}
 	}
-	return sig, err
+	return -1
+}
+
+// decryptPending asks for the passphrase of an encrypted key and moves it to the keyring.
+func (s *KeyRingAgent) decryptPending(key ssh.PublicKey) error {
+	s.decrypting.Lock()
+	defer s.decrypting.Unlock()
+
+	s.mu.Lock()
+	i := s.findPending(key)
+	if i < 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	k := s.pending[i]
+	s.mu.Unlock()
+
+	var priv interface{}
+	err := errPPKPassphrase
+	for retry := false; err == errPPKPassphrase; retry = true {
+		passphrase, perr := utils.PasswordPrompt(
+			"WinCrypt SSH Agent",
+			"Enter the passphrase of "+k.comment,
+			k.comment,
+			retry,
+		)
+		if perr != nil {
+			return perr
+		}
+		priv, err = k.decrypt(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.ag.Add(agent.AddedKey{PrivateKey: priv, Comment: k.comment}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.findPending(key); i >= 0 {
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+	}
+	return nil
+}
+
+// addPPK adds the key of a PuTTY private key file, encrypted keys are decrypted when they are first used.
+func (s *KeyRingAgent) addPPK(data []byte) error {
+	k, err := parsePPK(data)
+	if err != nil {
+		return err
+	}
+	if !k.encrypted() {
+		priv, err := k.decrypt("")
+		if err != nil {
+			return err
+		}
+		return s.AddKey(agent.AddedKey{PrivateKey: priv, Comment: k.comment})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findPending(k.publicKey) >= 0 {
+		return nil
+	}
+	if ids, err := s.ag.List(); err == nil {
+		for _, id := range ids {
+			if bytes.Equal(id.Blob, k.public) {
+				return nil
+			}
+		}
+	}
+	s.pending = append(s.pending, k)
+	utils.Notify(
+		"Key Added",
+		"Encrypted key <"+k.comment+"> has been added to keyring",
+	)
+	return nil
+}
+
+// Extension handles add-ppk@putty.projects.tartarus.org of Pageant.
+func (s *KeyRingAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != addPPKExtension {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	var msg struct {
+		File []byte
+	}
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, err
+	}
+	if err := s.addPPK(msg.File); err != nil {
+		println("add-ppk error:", err.Error())
+		return nil, err
+	}
+	return nil, nil
 }
 
 func (s *KeyRingAgent) findKeyComment(pubkey ssh.PublicKey) string {
 	wanted := pubkey.Marshal()
-	keys, err := s.List()
+	keys, err := s.ag.List()
 	if err != nil {
 		goto fallback
 	}
@@ -50,59 +189,79 @@ fallback:
 	return base64.StdEncoding.EncodeToString(wanted)
 }
 
-func (s *KeyRingAgent) Add(key agent.AddedKey) error {
+// AddKey stores a private key, certificates without their private key belong to other providers.
+func (s *KeyRingAgent) AddKey(key agent.AddedKey) error {
+	if key.Certificate != nil && !usablePrivateKey(key) {
+		return ErrKeyNotAccepted
+	}
 	err := s.ag.Add(key)
-	if err == nil {
-		defer utils.Notify(
-			"Key Added",
-			"Key <"+key.Comment+"> has been added to keyring",
-		)
+	if err != nil {
+		return err
 	}
-	return err
+	if key.ConfirmBeforeUse {
+		var pub ssh.PublicKey
+		if key.Certificate != nil {
+			pub = key.Certificate
+		} else if signer, err := ssh.NewSignerFromKey(key.PrivateKey); err == nil {
+			pub = signer.PublicKey()
+		}
+		if pub != nil {
+			s.mu.Lock()
+			s.confirm[string(pub.Marshal())] = true
+			s.mu.Unlock()
+		}
+	}
+	utils.Notify(
+		"Key Added",
+		"Key <"+key.Comment+"> has been added to keyring",
+	)
+	return nil
 }
 
-func (s *KeyRingAgent) Remove(key ssh.PublicKey) error {
-	comment := s.findKeyComment(key)
-	err := s.ag.Remove(key)
-	if err == nil {
-		defer utils.Notify(
+func (s *KeyRingAgent) RemoveKey(key ssh.PublicKey) error {
+	s.mu.Lock()
+	if i := s.findPending(key); i >= 0 {
+		comment := s.pending[i].comment
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+		s.mu.Unlock()
+		utils.Notify(
 			"Key Removed",
 			"Key <"+comment+"> has been removed from keyring",
 		)
+		return nil
+	}
+	s.mu.Unlock()
+	comment := s.findKeyComment(key)
+	err := s.ag.Remove(key)
+	if err != nil {
+		return err
 	}
-	return err
+	s.mu.Lock()
+	delete(s.confirm, string(key.Marshal()))
+	s.mu.Unlock()
+	utils.Notify(
+		"Key Removed",
+		"Key <"+comment+"> has been removed from keyring",
+	)
+	return nil
 }
 
-func (s *KeyRingAgent) RemoveAll() error {
+func (s *KeyRingAgent) RemoveAllKeys() error {
 	err := s.ag.RemoveAll()
-	if err == nil {
-		defer utils.Notify(
-			"Key Removed",
-			"All Keys have been removed from keyring",
-		)
+	if err != nil {
+		return err
 	}
-	return err
-}
-
-func (s *KeyRingAgent) Lock(passphrase []byte) error {
-	return s.ag.Lock(passphrase)
-}
-
-func (s *KeyRingAgent) Unlock(passphrase []byte) error {
-	return s.ag.Unlock(passphrase)
-}
-
-func (s *KeyRingAgent) Signers() ([]ssh.Signer, error) {
-	return s.ag.Signers()
-}
-
-func (s *KeyRingAgent) signed(comment string) {
+	s.mu.Lock()
+	s.confirm = make(map[string]bool)
+	s.pending = nil
+	s.mu.Unlock()
 	utils.Notify(
-		"Authenticated (Keyring)",
-		"Authentication Success by Key <"+comment+">",
+		"Key Removed",
+		"All Keys have been removed from keyring",
 	)
+	return nil
 }
 
-func (s *KeyRingAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
-	return nil, agent.ErrExtensionUnsupported
+func (s *KeyRingAgent) Signers() ([]ssh.Signer, error) {
+	return s.ag.Signers()
 }
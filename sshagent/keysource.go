@@ -0,0 +1,245 @@
+package sshagent
+
+import (
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/buptczq/WinCryptSSHAgent/capi"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+)
+
+const DefaultCommentTemplate = "{cn}"
+
+var errPasswordRequired = errors.New("keysource: password required")
+
+// KeySource is a certificate store or PFX file whose certificates with private keys are served by CAPIAgent.
+//
+// A source is written as store:<location>\<name> or pfx:<path>, followed by options separated by ";":
+// eku=any or a comma separated list of extended key usages instead of the default filter, and
+// comment=<template> with {cn}, {issuer}, {serial}, {thumbprint} and {source}.
+type KeySource struct {
+	Name string
+
+	location string
+	store    string
+	pfxFile  string
+	anyEKU   bool
+	ekus     []asn1.ObjectIdentifier
+	comment  string
+
+	mu        sync.Mutex
+	pfx       *capi.CertStore
+	cancelled bool
+	prompting bool
+}
+
+// DefaultKeySource is the personal store of the current user.
+func DefaultKeySource() *KeySource {
+	return &KeySource{
+		Name:     "CurrentUser\\My",
+		location: "CurrentUser",
+		store:    "My",
+		comment:  DefaultCommentTemplate,
+	}
+}
+
+func ParseKeySource(spec string) (*KeySource, error) {
+	parts := strings.Split(spec, ";")
+	source := &KeySource{comment: DefaultCommentTemplate}
+	kind := strings.SplitN(parts[0], ":", 2)
+	if len(kind) != 2 || kind[1] == "" {
+		return nil, fmt.Errorf("keysource: invalid source %s", parts[0])
+	}
+	switch strings.ToLower(kind[0]) {
+	case "store":
+		name := strings.SplitN(kind[1], "\\", 2)
+		if len(name) == 2 {
+			source.location, source.store = name[0], name[1]
+		} else {
+			source.location, source.store = "CurrentUser", name[0]
+		}
+		source.Name = source.location + "\\" + source.store
+	case "pfx":
+		source.pfxFile = kind[1]
+		source.Name = filepath.Base(kind[1])
+	default:
+		return nil, fmt.Errorf("keysource: unknown source type %s", kind[0])
+	}
+
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("keysource: invalid option %s", option)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "eku":
+			if strings.TrimSpace(kv[1]) == "any" {
+				source.anyEKU = true
+				continue
+			}
+			for _, v := range strings.Split(kv[1], ",") {
+				if v = strings.TrimSpace(v); v == "" {
+					continue
+				}
+				oid, err := parseEKU(v)
+				if err != nil {
+					return nil, fmt.Errorf("keysource: %v", err)
+				}
+				source.ekus = append(source.ekus, oid)
+			}
+		case "comment":
+			source.comment = kv[1]
+		default:
+			return nil, fmt.Errorf("keysource: unknown option %s", kv[0])
+		}
+	}
+	return source, nil
+}
+
+// certificates returns the certificates with private keys, a PFX file is opened once and kept in memory.
+// It never asks for a password, errPasswordRequired is returned until the file is opened with openPFX.
+func (s *KeySource) certificates() ([]*capi.Certificate, error) {
+	if s.pfxFile == "" {
+		store, err := capi.OpenSystemStore(s.location, s.store)
+		if err != nil {
+			return nil, err
+		}
+		defer store.Close()
+		return store.Certificates()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pfx == nil {
+		if s.cancelled || s.prompting {
+			return nil, nil
+		}
+		data, err := ioutil.ReadFile(s.pfxFile)
+		if err != nil {
+			return nil, err
+		}
+		// files without a password are opened without asking
+		store, err := capi.OpenPFX(data, "")
+		if err == capi.ERROR_INVALID_PASSWORD {
+			return nil, errPasswordRequired
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.pfx = store
+	}
+	return s.pfx.Certificates()
+}
+
+// openPFX asks for the password of the PFX file until it is opened or the prompt is cancelled.
+// It reports whether the file has been opened, only one prompt is shown at a time.
+func (s *KeySource) openPFX() (bool, error) {
+	s.mu.Lock()
+	if s.pfx != nil || s.cancelled || s.prompting {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.prompting = true
+	s.mu.Unlock()
+
+	store, err := s.promptPFX()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prompting = false
+	if err == utils.ErrCancelled {
+		s.cancelled = true
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.pfx = store
+	return true, nil
+}
+
+func (s *KeySource) promptPFX() (*capi.CertStore, error) {
+	data, err := ioutil.ReadFile(s.pfxFile)
+	if err != nil {
+		return nil, err
+	}
+	for retry := false; ; retry = true {
+		password, err := utils.PasswordPrompt(
+			"WinCrypt SSH Agent",
+			"Enter the password of "+s.pfxFile,
+			s.Name,
+			retry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		store, err := capi.OpenPFX(data, password)
+		if err != capi.ERROR_INVALID_PASSWORD {
+			return store, err
+		}
+	}
+}
+
+// retry lets a cancelled password prompt be shown again.
+func (s *KeySource) retry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancelled = false
+}
+
+func (s *KeySource) accepts(cert *capi.Certificate) bool {
+	if s.anyEKU {
+		return true
+	}
+	if s.ekus == nil {
+		return FilterCertificateEKU(cert)
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionExtendedKeyUsage) {
+			continue
+		}
+		var oids []asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(ext.Value, &oids); err != nil {
+			return false
+		}
+		for _, oid := range oids {
+			for _, wanted := range s.ekus {
+				if oid.Equal(wanted) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *KeySource) commentOf(cert *capi.Certificate) string {
+	thumbprint := sha1.Sum(cert.Raw)
+	return strings.NewReplacer(
+		"{cn}", cert.Subject.CommonName,
+		"{issuer}", cert.Issuer.CommonName,
+		"{serial}", cert.SerialNumber.String(),
+		"{thumbprint}", strings.ToUpper(hex.EncodeToString(thumbprint[:])),
+		"{source}", s.Name,
+	).Replace(s.comment)
+}
+
+func (s *KeySource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pfx == nil {
+		return nil
+	}
+	err := s.pfx.Close()
+	s.pfx = nil
+	return err
+}
@@ -0,0 +1,160 @@
+package sshagent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/capi"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ImportCommentPrefix in the comment of a key added with ssh-add asks for the key to be imported into the key store.
+const ImportCommentPrefix = "cng:"
+
+// KeyStore keeps private keys added with ssh-add outside of the process memory.
+type KeyStore interface {
+	// Import stores priv as a non-exportable key together with a self-signed certificate named after comment.
+	Import(priv crypto.Signer, comment string) error
+}
+
+// selfSignedCertificate returns a DER client authentication certificate for the key of signer.
+func selfSignedCertificate(signer crypto.Signer, commonName string, validity time.Duration) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+}
+
+// importKeyName is the CNG key name of an imported key, derived from its fingerprint so a second import replaces it.
+func importKeyName(priv crypto.Signer) (string, error) {
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		return "", err
+	}
+	return "WinCryptSSHAgent-" + strings.TrimPrefix(ssh.FingerprintSHA256(pub), "SHA256:"), nil
+}
+
+const importedCertValidity = 10 * 365 * 24 * time.Hour
+
+// CNGKeyStore imports keys into a CNG key storage provider and their certificates into the user's My store.
+type CNGKeyStore struct {
+	// Provider is the name of the key storage provider, capi.MS_KEY_STORAGE_PROVIDER if empty.
+	Provider string
+}
+
+func (s *CNGKeyStore) Import(priv crypto.Signer, comment string) error {
+	name, err := importKeyName(priv)
+	if err != nil {
+		return err
+	}
+	providerName := s.Provider
+	if providerName == "" {
+		providerName = capi.MS_KEY_STORAGE_PROVIDER
+	}
+	provider, err := capi.OpenKeyStorageProvider(providerName)
+	if err != nil {
+		return err
+	}
+	defer provider.Close()
+	key, err := provider.ImportKey(name, priv, false)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	// sign the certificate with the imported key, which also proves the import worked
+	der, err := selfSignedCertificate(key, comment, importedCertValidity)
+	if err != nil {
+		return err
+	}
+	return capi.AddUserCertificate(der, key)
+}
+
+// SoftwareKeyStore keeps imported keys in memory, it stands in for CNGKeyStore in tests.
+type SoftwareKeyStore struct {
+	mu    sync.Mutex
+	keys  map[string]crypto.Signer
+	certs map[string]*x509.Certificate
+}
+
+func (s *SoftwareKeyStore) Import(priv crypto.Signer, comment string) error {
+	name, err := importKeyName(priv)
+	if err != nil {
+		return err
+	}
+	der, err := selfSignedCertificate(priv, comment, importedCertValidity)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]crypto.Signer)
+		s.certs = make(map[string]*x509.Certificate)
+	}
+	s.keys[name] = priv
+	s.certs[name] = cert
+	return nil
+}
+
+// Certificates returns the certificates of the imported keys.
+func (s *SoftwareKeyStore) Certificates() []*x509.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	certs := make([]*x509.Certificate, 0, len(s.certs))
+	for _, cert := range s.certs {
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// Signer returns the imported key of cert.
+func (s *SoftwareKeyStore) Signer(cert *x509.Certificate) (crypto.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, c := range s.certs {
+		if c.Equal(cert) {
+			return s.keys[name], nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+// keyImporter is implemented by agents which take private keys added with ssh-add into a key store.
+type keyImporter interface {
+	imports(key agent.AddedKey) (bool, string)
+}
+
+// importRequested reports whether an added key should go to the key store, and the comment without the prefix.
+func importRequested(key agent.AddedKey, importAll bool) (bool, string) {
+	if key.Certificate != nil {
+		return false, key.Comment
+	}
+	if strings.HasPrefix(key.Comment, ImportCommentPrefix) {
+		return true, strings.TrimPrefix(key.Comment, ImportCommentPrefix)
+	}
+	return importAll, key.Comment
+}
@@ -0,0 +1,138 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestImportRequested(t *testing.T) {
+	cert := &ssh.Certificate{}
+	tests := []struct {
+		key       agent.AddedKey
+		importAll bool
+		want      bool
+		comment   string
+	}{
+		{agent.AddedKey{Comment: "alice"}, false, false, "alice"},
+		{agent.AddedKey{Comment: "alice"}, true, true, "alice"},
+		{agent.AddedKey{Comment: "cng:alice"}, false, true, "alice"},
+		{agent.AddedKey{Comment: "cng:alice", Certificate: cert}, true, false, "cng:alice"},
+	}
+	for _, tt := range tests {
+		got, comment := importRequested(tt.key, tt.importAll)
+		if got != tt.want || comment != tt.comment {
+			t.Errorf("importRequested(%q, %v) = %v, %q, want %v, %q", tt.key.Comment, tt.importAll, got, comment, tt.want, tt.comment)
+		}
+	}
+}
+
+// importedKey returns the certificate of the key pub in the store, or nil.
+func importedKey(t *testing.T, store *SoftwareKeyStore, pub ssh.PublicKey) *x509.Certificate {
+	for _, cert := range store.Certificates() {
+		signer, err := store.Signer(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ssh.NewPublicKey(signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(got.Marshal(), pub.Marshal()) {
+			return cert
+		}
+	}
+	return nil
+}
+
+func TestComposedAgentImport(t *testing.T) {
+	tempHome(t)
+	store := new(SoftwareKeyStore)
+	capiAgent := &CAPIAgent{KeyStore: store}
+	defer capiAgent.Close()
+	keyring := NewKeyRingAgent()
+	ag := NewComposedAgent(capiAgent, keyring)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, _ := ssh.NewPublicKey(&ecKey.PublicKey)
+	rsaPub, _ := ssh.NewPublicKey(&rsaKey.PublicKey)
+
+	// the prefix asks for the import and is not part of the certificate name
+	if err := ag.Add(agent.AddedKey{PrivateKey: ecKey, Comment: "cng:alice"}); err != nil {
+		t.Fatal(err)
+	}
+	cert := importedKey(t, store, ecPub)
+	if cert == nil {
+		t.Fatal("key with the import prefix not imported")
+	}
+	if cert.Subject.CommonName != "alice" {
+		t.Errorf("common name = %q, want alice", cert.Subject.CommonName)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("extended key usage = %v, want client authentication", cert.ExtKeyUsage)
+	}
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		t.Errorf("certificate is not self-signed: %v", err)
+	}
+	if keys, _ := keyring.Keys(); len(keys) != 0 {
+		t.Error("imported key also added to the keyring")
+	}
+
+	// without the prefix the key stays in memory
+	if err := ag.Add(agent.AddedKey{PrivateKey: rsaKey, Comment: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if importedKey(t, store, rsaPub) != nil {
+		t.Error("key without the import prefix imported")
+	}
+	if keys, _ := keyring.Keys(); len(keys) != 1 || keys[0].Comment != "bob" {
+		t.Errorf("keyring keys = %v, want bob", keys)
+	}
+
+	for _, key := range []agent.AddedKey{
+		{PrivateKey: rsaKey, Comment: "cng:carol", LifetimeSecs: 60},
+		{PrivateKey: rsaKey, Comment: "cng:carol", ConfirmBeforeUse: true},
+		{PrivateKey: edKey, Comment: "cng:dave"},
+	} {
+		if err := ag.Add(key); err == nil {
+			t.Errorf("Add(%q) with lifetime %d and confirm %v imported the key", key.Comment, key.LifetimeSecs, key.ConfirmBeforeUse)
+		}
+	}
+	if len(store.Certificates()) != 1 {
+		t.Errorf("store holds %d keys, want 1", len(store.Certificates()))
+	}
+
+	// with ImportKeys every key is imported, and a key hidden with ssh-add -d is offered again
+	if err := capiAgent.hiddenKeys().hide(rsaPub, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	capiAgent.ImportKeys = true
+	if err := ag.Add(agent.AddedKey{PrivateKey: rsaKey, Comment: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if cert := importedKey(t, store, rsaPub); cert == nil || cert.Subject.CommonName != "bob" {
+		t.Error("key not imported with ImportKeys")
+	}
+	if capiAgent.hiddenKeys().hidden(rsaPub) {
+		t.Error("imported key is still hidden")
+	}
+}
@@ -0,0 +1,15 @@
+package sshagent
+
+var keysChanged = make(chan struct{}, 1)
+
+// KeysChanged is signaled when keys are added to or removed from the agent.
+func KeysChanged() <-chan struct{} {
+	return keysChanged
+}
+
+func notifyKeysChanged() {
+	select {
+	case keysChanged <- struct{}{}:
+	default:
+	}
+}
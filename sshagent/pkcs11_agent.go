@@ -0,0 +1,221 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buptczq/WinCryptSSHAgent/p11"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+type pkcs11Module struct {
+	path    string
+	module  *p11.Module
+	expire  *time.Time
+	confirm bool
+}
+
+// PKCS11Agent serves the keys of PKCS #11 modules, loaded with ssh-add -s and unloaded with ssh-add -e.
+type PKCS11Agent struct {
+	// Allowed are the folders modules may be loaded from with ssh-add -s, DefaultPKCS11Folders if empty.
+	Allowed []string
+
+	mu sync.Mutex
+	// modules in the order they were loaded, which is the order of their keys
+	modules []*pkcs11Module
+}
+
+// DefaultPKCS11Folders are the program and system folders.
+func DefaultPKCS11Folders() []string {
+	var folders []string
+	for _, env := range []string{"ProgramFiles", "ProgramFiles(x86)", "SystemRoot"} {
+		if v := os.Getenv(env); v != "" {
+			if env == "SystemRoot" {
+				v = filepath.Join(v, "System32")
+			}
+			folders = append(folders, v)
+		}
+	}
+	return folders
+}
+
+func (s *PKCS11Agent) allowed(path string) bool {
+	folders := s.Allowed
+	if len(folders) == 0 {
+		folders = DefaultPKCS11Folders()
+	}
+	for _, folder := range folders {
+		rel, err := filepath.Rel(folder, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadModule loads a module given on the command line, it is not checked against Allowed.
+func (s *PKCS11Agent) LoadModule(path, pin string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load(path, pin, 0, false)
+}
+
+func (s *PKCS11Agent) find(path string) int {
+	for i, m := range s.modules {
+		if m.path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *PKCS11Agent) load(path, pin string, lifetimeSecs uint32, confirm bool) error {
+	if s.find(path) >= 0 {
+		return fmt.Errorf("agent: %s is already loaded", path)
+	}
+	module, err := p11.Open(path, pin)
+	if err != nil {
+		return err
+	}
+	m := &pkcs11Module{path: path, module: module, confirm: confirm}
+	if lifetimeSecs > 0 {
+		t := time.Now().Add(time.Duration(lifetimeSecs) * time.Second)
+		m.expire = &t
+	}
+	s.modules = append(s.modules, m)
+	notifyKeysChanged()
+	return nil
+}
+
+func (s *PKCS11Agent) AddSmartcardKey(reader, pin string, lifetimeSecs uint32, confirm bool) error {
+	path, err := filepath.Abs(reader)
+	if err != nil {
+		return err
+	}
+	if !s.allowed(path) {
+		return fmt.Errorf("agent: %s is not in an allowed folder", path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(path, pin, lifetimeSecs, confirm); err != nil {
+		return err
+	}
+	utils.Notify(
+		"Key Added",
+		"Keys of <"+filepath.Base(path)+"> have been added",
+	)
+	return nil
+}
+
+func (s *PKCS11Agent) RemoveSmartcardKey(reader, pin string) error {
+	path, err := filepath.Abs(reader)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(path)
+	if i < 0 {
+		return errors.New("not found")
+	}
+	m := s.modules[i]
+	s.modules = append(s.modules[:i], s.modules[i+1:]...)
+	notifyKeysChanged()
+	utils.Notify(
+		"Key Removed",
+		"Keys of <"+filepath.Base(path)+"> have been removed",
+	)
+	return m.module.Close()
+}
+
+func (s *PKCS11Agent) expireModules() {
+	now := time.Now()
+	modules := s.modules[:0]
+	for _, m := range s.modules {
+		if m.expire != nil && !now.Before(*m.expire) {
+			m.module.Close()
+			notifyKeysChanged()
+			continue
+		}
+		modules = append(modules, m)
+	}
+	s.modules = modules
+}
+
+func keyComment(key *p11.Key, path string) string {
+	if key.Label != "" {
+		return key.Label
+	}
+	return path
+}
+
+func (s *PKCS11Agent) Keys() ([]*ProviderKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireModules()
+	var keys []*ProviderKey
+	for _, m := range s.modules {
+		for _, key := range m.module.Keys() {
+			keys = append(keys, &ProviderKey{
+				PublicKey: key.PublicKey(),
+				Comment:   keyComment(key, m.path),
+				Confirm:   m.confirm,
+			})
+		}
+	}
+	return keys, nil
+}
+
+func (s *PKCS11Agent) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireModules()
+	wanted := key.Marshal()
+	for _, m := range s.modules {
+		for _, k := range m.module.Keys() {
+			if bytes.Equal(k.PublicKey().Marshal(), wanted) {
+				return k.SignWithAlgorithm(rand.Reader, data, algorithm)
+			}
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+// RemoveAllKeys unloads all modules, like ssh-add -D does with OpenSSH.
+func (s *PKCS11Agent) RemoveAllKeys() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.modules {
+		m.module.Close()
+	}
+	if len(s.modules) > 0 {
+		s.modules = nil
+		notifyKeysChanged()
+	}
+	return nil
+}
+
+// RemoveKey leaves single keys alone, modules are unloaded with ssh-add -e.
+func (s *PKCS11Agent) RemoveKey(key ssh.PublicKey) error {
+	return errors.New("not found")
+}
+
+func (s *PKCS11Agent) Close() error {
+	return s.RemoveAllKeys()
+}
@@ -0,0 +1,389 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// PuTTY agent extensions
+const (
+	listExtendedExtension = "list-extended@putty.projects.tartarus.org"
+	addPPKExtension       = "add-ppk@putty.projects.tartarus.org"
+
+	listExtendedHasEncryptedKeyFile = 1
+	listExtendedHasNoCleartextKey   = 2
+)
+
+var errPPKPassphrase = errors.New("ppk: wrong passphrase")
+
+// ppkKey is a key of a PuTTY private key file (PPK version 2 or 3) with its private part still encrypted.
+type ppkKey struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	publicKey  ssh.PublicKey
+	public     []byte
+	private    []byte
+	mac        []byte
+
+	// argon2 parameters of version 3
+	kdf         string
+	memory      uint32
+	passes      uint32
+	parallelism uint8
+	salt        []byte
+}
+
+type ppkReader struct {
+	lines []string
+}
+
+// header returns the value of the next line, which must be a header called name.
+func (r *ppkReader) header(name string) (string, error) {
+	if len(r.lines) == 0 {
+		return "", errors.New("ppk: missing " + name)
+	}
+	kv := strings.SplitN(r.lines[0], ": ", 2)
+	if len(kv) != 2 || kv[0] != name {
+		return "", errors.New("ppk: missing " + name)
+	}
+	r.lines = r.lines[1:]
+	return kv[1], nil
+}
+
+func (r *ppkReader) number(name string) (uint32, error) {
+	v, err := r.header(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, errors.New("ppk: invalid " + name)
+	}
+	return uint32(n), nil
+}
+
+// blob reads the base64 lines counted by the header name.
+func (r *ppkReader) blob(name string) ([]byte, error) {
+	n, err := r.number(name)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > len(r.lines) {
+		return nil, errors.New("ppk: truncated file")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(r.lines[:n], ""))
+	if err != nil {
+		return nil, errors.New("ppk: invalid " + name)
+	}
+	r.lines = r.lines[n:]
+	return data, nil
+}
+
+func parsePPK(data []byte) (*ppkKey, error) {
+	r := &ppkReader{lines: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")}
+	k := new(ppkKey)
+	var err error
+	if k.algorithm, err = r.header("PuTTY-User-Key-File-3"); err == nil {
+		k.version = 3
+	} else if k.algorithm, err = r.header("PuTTY-User-Key-File-2"); err == nil {
+		k.version = 2
+	} else {
+		return nil, errors.New("ppk: not a PuTTY private key file of version 2 or 3")
+	}
+	if k.encryption, err = r.header("Encryption"); err != nil {
+		return nil, err
+	}
+	if k.encryption != "none" && k.encryption != "aes256-cbc" {
+		return nil, errors.New("ppk: unsupported encryption " + k.encryption)
+	}
+	if k.comment, err = r.header("Comment"); err != nil {
+		return nil, err
+	}
+	if k.public, err = r.blob("Public-Lines"); err != nil {
+		return nil, err
+	}
+	if k.publicKey, err = ssh.ParsePublicKey(k.public); err != nil {
+		return nil, err
+	}
+	if k.publicKey.Type() != k.algorithm {
+		return nil, errors.New("ppk: key type does not match " + k.algorithm)
+	}
+	if k.version == 3 && k.encryption != "none" {
+		if k.kdf, err = r.header("Key-Derivation"); err != nil {
+			return nil, err
+		}
+		if k.kdf != "Argon2id" && k.kdf != "Argon2i" {
+			return nil, errors.New("ppk: unsupported key derivation " + k.kdf)
+		}
+		if k.memory, err = r.number("Argon2-Memory"); err != nil {
+			return nil, err
+		}
+		if k.passes, err = r.number("Argon2-Passes"); err != nil {
+			return nil, err
+		}
+		parallelism, err := r.number("Argon2-Parallelism")
+		if err != nil {
+			return nil, err
+		}
+		if parallelism == 0 || parallelism > 255 {
+			return nil, errors.New("ppk: invalid Argon2-Parallelism")
+		}
+		k.parallelism = uint8(parallelism)
+		salt, err := r.header("Argon2-Salt")
+		if err != nil {
+			return nil, err
+		}
+		if k.salt, err = hex.DecodeString(salt); err != nil {
+			return nil, errors.New("ppk: invalid Argon2-Salt")
+		}
+	}
+	if k.private, err = r.blob("Private-Lines"); err != nil {
+		return nil, err
+	}
+	if k.encryption != "none" && (len(k.private) == 0 || len(k.private)%aes.BlockSize != 0) {
+		return nil, errors.New("ppk: invalid private key length")
+	}
+	mac, err := r.header("Private-MAC")
+	if err != nil {
+		return nil, err
+	}
+	if k.mac, err = hex.DecodeString(mac); err != nil {
+		return nil, errors.New("ppk: invalid Private-MAC")
+	}
+	return k, nil
+}
+
+func (k *ppkKey) encrypted() bool {
+	return k.encryption != "none"
+}
+
+// keys derives the cipher key, IV and MAC of a passphrase.
+func (k *ppkKey) keys(passphrase string) (cipherKey, iv []byte, mac hash.Hash) {
+	if k.version == 2 {
+		if k.encrypted() {
+			var seq [4]byte
+			h0 := sha1.Sum(append(seq[:], passphrase...))
+			seq[3] = 1
+			h1 := sha1.Sum(append(seq[:], passphrase...))
+			cipherKey = append(h0[:], h1[:]...)[:32]
+			iv = make([]byte, aes.BlockSize)
+		}
+		macKey := sha1.Sum([]byte("putty-private-key-file-mac-key" + passphrase))
+		return cipherKey, iv, hmac.New(sha1.New, macKey[:])
+	}
+	if !k.encrypted() {
+		return nil, nil, hmac.New(sha256.New, nil)
+	}
+	var out []byte
+	if k.kdf == "Argon2i" {
+		out = argon2.Key([]byte(passphrase), k.salt, k.passes, k.memory, k.parallelism, 80)
+	} else {
+		out = argon2.IDKey([]byte(passphrase), k.salt, k.passes, k.memory, k.parallelism, 80)
+	}
+	return out[:32], out[32:48], hmac.New(sha256.New, out[48:])
+}
+
+// decrypt returns the private key, passphrase is ignored for unencrypted files.
+func (k *ppkKey) decrypt(passphrase string) (interface{}, error) {
+	if !k.encrypted() {
+		passphrase = ""
+	}
+	cipherKey, iv, mac := k.keys(passphrase)
+	private := append([]byte(nil), k.private...)
+	if cipherKey != nil {
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, private)
+	}
+
+	mac.Write(ssh.Marshal(struct {
+		Algorithm  string
+		Encryption string
+		Comment    string
+		Public     []byte
+		Private    []byte
+	}{k.algorithm, k.encryption, k.comment, k.public, private}))
+	if !hmac.Equal(mac.Sum(nil), k.mac) {
+		if k.encrypted() {
+			return nil, errPPKPassphrase
+		}
+		return nil, errors.New("ppk: corrupt private key")
+	}
+
+	priv, err := ppkPrivateKey(k.public, private)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), k.public) {
+		return nil, errors.New("ppk: private key does not match the public key")
+	}
+	return priv, nil
+}
+
+// ppkPrivateKey builds the private key of the public and private blobs of a PPK file,
+// the private blob may have padding.
+func ppkPrivateKey(public, private []byte) (interface{}, error) {
+	var name struct {
+		Name string
+		Rest []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(public, &name); err != nil {
+		return nil, err
+	}
+	switch name.Name {
+	case ssh.KeyAlgoRSA:
+		var pub struct {
+			Name string
+			E    *big.Int
+			N    *big.Int
+		}
+		var priv struct {
+			D    *big.Int
+			P    *big.Int
+			Q    *big.Int
+			Iqmp *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(public, &pub); err != nil {
+			return nil, err
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		if !pub.E.IsInt64() || pub.E.Int64() > 1<<31-1 {
+			return nil, errors.New("ppk: invalid RSA exponent")
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: pub.N, E: int(pub.E.Int64())},
+			D:         priv.D,
+			Primes:    []*big.Int{priv.P, priv.Q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case ssh.KeyAlgoDSA:
+		var pub struct {
+			Name string
+			P    *big.Int
+			Q    *big.Int
+			G    *big.Int
+			Y    *big.Int
+		}
+		var priv struct {
+			X    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(public, &pub); err != nil {
+			return nil, err
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		return &dsa.PrivateKey{
+			PublicKey: dsa.PublicKey{
+				Parameters: dsa.Parameters{P: pub.P, Q: pub.Q, G: pub.G},
+				Y:          pub.Y,
+			},
+			X: priv.X,
+		}, nil
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var pub struct {
+			Name  string
+			Curve string
+			Q     []byte
+		}
+		var priv struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(public, &pub); err != nil {
+			return nil, err
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		var curve elliptic.Curve
+		switch pub.Curve {
+		case "nistp256":
+			curve = elliptic.P256()
+		case "nistp384":
+			curve = elliptic.P384()
+		case "nistp521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("ppk: unsupported curve " + pub.Curve)
+		}
+		x, y := elliptic.Unmarshal(curve, pub.Q)
+		if x == nil {
+			return nil, errors.New("ppk: invalid ECDSA public key")
+		}
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         priv.D,
+		}, nil
+	case ssh.KeyAlgoED25519:
+		var priv struct {
+			// little endian without trailing zeros
+			Seed []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		if len(priv.Seed) > ed25519.SeedSize {
+			return nil, errors.New("ppk: invalid Ed25519 private key")
+		}
+		seed := make([]byte, ed25519.SeedSize)
+		copy(seed, priv.Seed)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	return nil, errors.New("ppk: unsupported key type " + name.Name)
+}
+
+// listExtended returns the reply of list-extended@putty.projects.tartarus.org.
+func listExtended(keys []*ownedKey) []byte {
+	reply := []byte{agentSuccess, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(reply[1:], uint32(len(keys)))
+	for _, k := range keys {
+		var flags [4]byte
+		if k.Encrypted {
+			binary.BigEndian.PutUint32(flags[:], listExtendedHasEncryptedKeyFile|listExtendedHasNoCleartextKey)
+		}
+		reply = append(reply, ssh.Marshal(struct {
+			Blob       []byte
+			Comment    string
+			Properties []byte
+		}{k.PublicKey.Marshal(), k.Comment, flags[:]})...)
+	}
+	return reply
+}
@@ -0,0 +1,576 @@
+package sshagent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrKeyNotAccepted is returned by a KeyAdder for keys which belong to another provider.
+var ErrKeyNotAccepted = errors.New("agent: key not accepted")
+
+var errLocked = errors.New("agent: locked")
+
+// confirmKeyUse asks the user before a key with ProviderKey.Confirm is used.
+var confirmKeyUse = func(message string) bool {
+	return utils.MessageBox("Confirm:", message, utils.MB_OKCANCEL) == utils.IDOK
+}
+
+// ProviderKey is a key offered by a KeyProvider.
+type ProviderKey struct {
+	PublicKey ssh.PublicKey
+	Comment   string
+	// Kind names the key in notifications, "Key" if empty.
+	Kind string
+	// Confirm asks the user before each use of the key.
+	Confirm bool
+	// Encrypted is set while the private key is encrypted, it is decrypted on first use.
+	Encrypted bool
+}
+
+// KeyProvider is a source of keys served by ComposedAgent.
+type KeyProvider interface {
+	Keys() ([]*ProviderKey, error)
+	// SignWithAlgorithm signs data, an empty algorithm selects the default of the key type.
+	SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error)
+}
+
+// KeyAdder is implemented by providers taking keys added with ssh-add.
+type KeyAdder interface {
+	AddKey(key agent.AddedKey) error
+}
+
+// KeyRemover is implemented by providers whose keys can be removed with ssh-add -d and -D.
+type KeyRemover interface {
+	RemoveKey(key ssh.PublicKey) error
+	RemoveAllKeys() error
+}
+
+// KeyLocker is implemented by providers which release resources while the agent is locked,
+// or which lock another agent with the same passphrase.
+type KeyLocker interface {
+	LockKeys(passphrase []byte) error
+	UnlockKeys(passphrase []byte) error
+}
+
+// ExtensionHandler is implemented by providers handling agent extensions,
+// they return agent.ErrExtensionUnsupported for unknown extensions.
+type ExtensionHandler interface {
+	Extension(extensionType string, contents []byte) ([]byte, error)
+}
+
+type ownedKey struct {
+	*ProviderKey
+	provider KeyProvider
+}
+
+// ComposedAgent serves the keys of several providers as one agent.
+// Keys are listed in the order of the providers, the first provider takes
+// the keys added with ssh-add which no other provider accepts.
+type ComposedAgent struct {
+	providers []KeyProvider
+
+	mu         sync.Mutex
+	owners     map[string]*ownedKey
+	locked     bool
+	passphrase []byte
+}
+
+func NewComposedAgent(providers ...KeyProvider) *ComposedAgent {
+	return &ComposedAgent{
+		providers: providers,
+	}
+}
+
+// keys lists the keys of all providers and remembers which provider owns each key,
+// a provider which fails is skipped so the keys of the others are still served.
+// It is called without holding a.mu, so slow providers do not block other requests.
+func (a *ComposedAgent) keys() []*ownedKey {
+	var all []*ownedKey
+	owners := make(map[string]*ownedKey)
+	for _, provider := range a.providers {
+		keys, err := provider.Keys()
+		if err != nil {
+			println("agent: key provider error:", err.Error())
+			continue
+		}
+		for _, key := range keys {
+			owned := &ownedKey{ProviderKey: key, provider: provider}
+			blob := string(key.PublicKey.Marshal())
+			if _, ok := owners[blob]; !ok {
+				owners[blob] = owned
+			}
+			all = append(all, owned)
+		}
+	}
+	a.mu.Lock()
+	if !a.locked {
+		a.owners = owners
+	}
+	a.mu.Unlock()
+	return all
+}
+
+// Locked reports whether the agent is locked with ssh-add -x.
+func (a *ComposedAgent) Locked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.locked
+}
+
+func (a *ComposedAgent) List() ([]*agent.Key, error) {
+	return a.list(nil)
+}
+
+func (a *ComposedAgent) list(visible func(*ProviderKey) bool) ([]*agent.Key, error) {
+	if a.Locked() {
+		return nil, nil
+	}
+	keys := a.keys()
+	ids := make([]*agent.Key, 0, len(keys))
+	for _, k := range keys {
+		if visible != nil && !visible(k.ProviderKey) {
+			continue
+		}
+		ids = append(ids, &agent.Key{
+			Format:  k.PublicKey.Type(),
+			Blob:    k.PublicKey.Marshal(),
+			Comment: k.Comment,
+		})
+	}
+	return ids, nil
+}
+
+func (a *ComposedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *ComposedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return a.sign("", nil, key, data, flags)
+}
+
+func (a *ComposedAgent) sign(client string, visible func(*ProviderKey) bool, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	algorithm, err := signatureAlgorithm(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	if a.locked {
+		a.mu.Unlock()
+		return nil, errLocked
+	}
+	blob := string(key.Marshal())
+	owner, ok := a.owners[blob]
+	a.mu.Unlock()
+	if !ok {
+		a.keys()
+		a.mu.Lock()
+		owner, ok = a.owners[blob]
+		a.mu.Unlock()
+	}
+	if !ok || (visible != nil && !visible(owner.ProviderKey)) {
+		return nil, errors.New("not found")
+	}
+
+	kind := owner.Kind
+	if kind == "" {
+		kind = "Key"
+	}
+	from := ""
+	if client != "" {
+		from = " for " + client
+	}
+	if owner.Confirm && !confirmKeyUse("Allow use of "+kind+" <"+owner.Comment+">"+from+"?") {
+		return nil, errors.New("agent: confirmation denied")
+	}
+	sig, err := owner.provider.SignWithAlgorithm(key, data, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if client != "" {
+		utils.Audit("agent: signed with %s <%s> %s for %s", kind, owner.Comment, ssh.FingerprintSHA256(key), client)
+	}
+	utils.Notify(
+		"Authenticated",
+		"Authentication Success by "+kind+" <"+owner.Comment+">"+from,
+	)
+	return sig, nil
+}
+
+var errRestricted = errors.New("agent: keys cannot be changed by a client with restricted keys")
+
+// clientAgent is the view of a ComposedAgent for one client, e.g. a virtual machine.
+// A client which only sees some keys is read-only, it can neither change nor lock the keys.
+type clientAgent struct {
+	*ComposedAgent
+	client  string
+	visible func(*ProviderKey) bool
+}
+
+// ForClient returns the agent for a named client which only sees keys accepted by visible, all keys if nil.
+// The client is named in notifications and in the audit log.
+func (a *ComposedAgent) ForClient(client string, visible func(*ProviderKey) bool) agent.ExtendedAgent {
+	return &clientAgent{
+		ComposedAgent: a,
+		client:        client,
+		visible:       visible,
+	}
+}
+
+func (a *clientAgent) List() ([]*agent.Key, error) {
+	return a.list(a.visible)
+}
+
+func (a *clientAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *clientAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return a.sign(a.client, a.visible, key, data, flags)
+}
+
+func (a *clientAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("agent: signers are not available to clients")
+}
+
+func (a *clientAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if a.visible != nil && extensionType == addPPKExtension {
+		return nil, errRestricted
+	}
+	return a.extension(a.visible, extensionType, contents)
+}
+
+func (a *clientAgent) Add(key agent.AddedKey) error {
+	if a.visible != nil {
+		return errRestricted
+	}
+	return a.ComposedAgent.Add(key)
+}
+
+func (a *clientAgent) Remove(key ssh.PublicKey) error {
+	if a.visible != nil {
+		return errRestricted
+	}
+	return a.ComposedAgent.Remove(key)
+}
+
+func (a *clientAgent) RemoveAll() error {
+	if a.visible != nil {
+		return errRestricted
+	}
+	return a.ComposedAgent.RemoveAll()
+}
+
+func (a *clientAgent) Lock(passphrase []byte) error {
+	if a.visible != nil {
+		return errRestricted
+	}
+	return a.ComposedAgent.Lock(passphrase)
+}
+
+func (a *clientAgent) Unlock(passphrase []byte) error {
+	if a.visible != nil {
+		return errRestricted
+	}
+	return a.ComposedAgent.Unlock(passphrase)
+}
+
+func (a *ComposedAgent) Add(key agent.AddedKey) error {
+	if a.Locked() {
+		return errLocked
+	}
+
+	err := a.add(key)
+	if err == nil {
+		notifyKeysChanged()
+	}
+	return err
+}
+
+func (a *ComposedAgent) add(key agent.AddedKey) error {
+	for _, provider := range a.providers {
+		if importer, ok := provider.(keyImporter); ok {
+			if imports, _ := importer.imports(key); imports {
+				return provider.(KeyAdder).AddKey(key)
+			}
+		}
+	}
+	var firstError error
+	for _, provider := range a.providers {
+		adder, ok := provider.(KeyAdder)
+		if !ok {
+			continue
+		}
+		err := adder.AddKey(key)
+		if err == nil {
+			return nil
+		}
+		if err != ErrKeyNotAccepted && firstError == nil {
+			firstError = err
+		}
+	}
+	if firstError != nil {
+		return firstError
+	}
+	if key.Certificate != nil {
+		return errors.New("agent: no key for certificate")
+	}
+	return errors.New("agent: keys cannot be added")
+}
+
+func (a *ComposedAgent) Remove(key ssh.PublicKey) error {
+	if a.Locked() {
+		return errLocked
+	}
+
+	var firstError error
+	for _, provider := range a.providers {
+		remover, ok := provider.(KeyRemover)
+		if !ok {
+			continue
+		}
+		err := remover.RemoveKey(key)
+		if err == nil {
+			notifyKeysChanged()
+			return nil
+		}
+		if firstError == nil {
+			firstError = err
+		}
+	}
+	if firstError == nil {
+		firstError = errors.New("not found")
+	}
+	return firstError
+}
+
+func (a *ComposedAgent) RemoveAll() error {
+	if a.Locked() {
+		return errLocked
+	}
+
+	var err error
+	for _, provider := range a.providers {
+		if remover, ok := provider.(KeyRemover); ok {
+			if rerr := remover.RemoveAllKeys(); err == nil {
+				err = rerr
+			}
+		}
+	}
+	notifyKeysChanged()
+	return err
+}
+
+func (a *ComposedAgent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.locked {
+		return errLocked
+	}
+	a.locked = true
+	a.passphrase = passphrase
+	a.owners = nil
+	for _, provider := range a.providers {
+		if locker, ok := provider.(KeyLocker); ok {
+			if err := locker.LockKeys(passphrase); err != nil {
+				println("agent lock error:", err.Error())
+			}
+		}
+	}
+	utils.Notify("Agent Locked", "All keys are locked until the agent is unlocked")
+	return nil
+}
+
+func (a *ComposedAgent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.locked {
+		return errors.New("agent: not locked")
+	}
+	if subtle.ConstantTimeCompare(passphrase, a.passphrase) != 1 {
+		return errors.New("agent: incorrect passphrase")
+	}
+	a.locked = false
+	a.passphrase = nil
+	for _, provider := range a.providers {
+		if locker, ok := provider.(KeyLocker); ok {
+			if err := locker.UnlockKeys(passphrase); err != nil {
+				println("agent unlock error:", err.Error())
+			}
+		}
+	}
+	utils.Notify("Agent Unlocked", "All keys are available again")
+	return nil
+}
+
+func (a *ComposedAgent) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.locked {
+		return nil, errLocked
+	}
+	var signers []ssh.Signer
+	for _, provider := range a.providers {
+		if p, ok := provider.(interface{ Signers() ([]ssh.Signer, error) }); ok {
+			s, err := p.Signers()
+			if err != nil {
+				return nil, err
+			}
+			signers = append(signers, s...)
+		}
+	}
+	return signers, nil
+}
+
+func (a *ComposedAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return a.extension(nil, extensionType, contents)
+}
+
+func (a *ComposedAgent) extension(visible func(*ProviderKey) bool, extensionType string, contents []byte) ([]byte, error) {
+	if a.Locked() {
+		return nil, errLocked
+	}
+	if extensionType == listExtendedExtension {
+		keys := a.keys()
+		shown := keys[:0]
+		for _, k := range keys {
+			if visible == nil || visible(k.ProviderKey) {
+				shown = append(shown, k)
+			}
+		}
+		return listExtended(shown), nil
+	}
+
+	for _, provider := range a.providers {
+		handler, ok := provider.(ExtensionHandler)
+		if !ok {
+			continue
+		}
+		resp, err := handler.Extension(extensionType, contents)
+		if err != agent.ErrExtensionUnsupported {
+			return resp, err
+		}
+	}
+	return nil, agent.ErrExtensionUnsupported
+}
+
+func (a *ComposedAgent) X509Certificate(key ssh.PublicKey) (*x509.Certificate, error) {
+	if a.Locked() {
+		return nil, errLocked
+	}
+
+	for _, provider := range a.providers {
+		if p, ok := provider.(CertificateProvider); ok {
+			if cert, err := p.X509Certificate(key); err == nil {
+				return cert, nil
+			}
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (a *ComposedAgent) AddSmartcardKey(reader, pin string, lifetimeSecs uint32, confirm bool) error {
+	if a.Locked() {
+		return errLocked
+	}
+
+	for _, provider := range a.providers {
+		if sc, ok := provider.(SmartcardAgent); ok {
+			return sc.AddSmartcardKey(reader, pin, lifetimeSecs, confirm)
+		}
+	}
+	return errors.New("agent: smartcard keys are not supported")
+}
+
+func (a *ComposedAgent) RemoveSmartcardKey(reader, pin string) error {
+	if a.Locked() {
+		return errLocked
+	}
+
+	for _, provider := range a.providers {
+		if sc, ok := provider.(SmartcardAgent); ok {
+			return sc.RemoveSmartcardKey(reader, pin)
+		}
+	}
+	return errors.New("agent: smartcard keys are not supported")
+}
+
+func (a *ComposedAgent) HiddenKeys() []string {
+	var keys []string
+	for _, provider := range a.providers {
+		if hider, ok := provider.(KeyHider); ok {
+			keys = append(keys, hider.HiddenKeys()...)
+		}
+	}
+	return keys
+}
+
+func (a *ComposedAgent) RestoreHiddenKey(fingerprint string) error {
+	for _, provider := range a.providers {
+		if hider, ok := provider.(KeyHider); ok {
+			if err := hider.RestoreHiddenKey(fingerprint); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *ComposedAgent) RestoreHiddenKeys() error {
+	for _, provider := range a.providers {
+		if hider, ok := provider.(KeyHider); ok {
+			if err := hider.RestoreHiddenKeys(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// signatureAlgorithm maps the RSA signature flags of a sign request to a signature algorithm.
+func signatureAlgorithm(flags agent.SignatureFlags) (string, error) {
+	switch flags {
+	case 0:
+		return "", nil
+	case agent.SignatureFlagRsaSha256:
+		return ssh.SigAlgoRSASHA2256, nil
+	case agent.SignatureFlagRsaSha512:
+		return ssh.SigAlgoRSASHA2512, nil
+	}
+	return "", fmt.Errorf("agent: unsupported signature flags: %d", flags)
+}
+
+// signatureFlags is the inverse of signatureAlgorithm, for providers forwarding to another agent.
+func signatureFlags(algorithm string) agent.SignatureFlags {
+	switch algorithm {
+	case ssh.SigAlgoRSASHA2256:
+		return agent.SignatureFlagRsaSha256
+	case ssh.SigAlgoRSASHA2512:
+		return agent.SignatureFlagRsaSha512
+	}
+	return 0
+}
+
+// signWithAlgorithm signs with the default algorithm of signer if algorithm is empty.
+func signWithAlgorithm(signer ssh.Signer, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithm == "" {
+		return signer.Sign(rand.Reader, data)
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("agent: signature does not support non-default signature algorithm: %T", signer)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
@@ -0,0 +1,360 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// fakeProvider is an in-memory KeyProvider which records the requests it gets.
+type fakeProvider struct {
+	keys    []*ProviderKey
+	signers map[string]ssh.Signer
+	err     error
+	// block holds Keys until it is closed
+	block chan struct{}
+
+	signed  int
+	added   []agent.AddedKey
+	locked  []byte
+	removed int
+}
+
+func (p *fakeProvider) addKey(t *testing.T, comment string, confirm bool) ssh.PublicKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.share(signer, comment, confirm)
+	return signer.PublicKey()
+}
+
+// share serves a signer which may also be served by another provider.
+func (p *fakeProvider) share(signer ssh.Signer, comment string, confirm bool) {
+	if p.signers == nil {
+		p.signers = make(map[string]ssh.Signer)
+	}
+	p.signers[string(signer.PublicKey().Marshal())] = signer
+	p.keys = append(p.keys, &ProviderKey{PublicKey: signer.PublicKey(), Comment: comment, Confirm: confirm})
+}
+
+func (p *fakeProvider) Keys() ([]*ProviderKey, error) {
+	if p.block != nil {
+		<-p.block
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.keys, nil
+}
+
+func (p *fakeProvider) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, ok := p.signers[string(key.Marshal())]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	p.signed++
+	return signer.Sign(rand.Reader, data)
+}
+
+func (p *fakeProvider) AddKey(key agent.AddedKey) error {
+	p.added = append(p.added, key)
+	return nil
+}
+
+func (p *fakeProvider) RemoveKey(key ssh.PublicKey) error {
+	p.removed++
+	return nil
+}
+
+func (p *fakeProvider) RemoveAllKeys() error {
+	p.removed++
+	return nil
+}
+
+func (p *fakeProvider) LockKeys(passphrase []byte) error {
+	p.locked = passphrase
+	return nil
+}
+
+func (p *fakeProvider) UnlockKeys(passphrase []byte) error {
+	p.locked = nil
+	return nil
+}
+
+func TestComposedAgentRouting(t *testing.T) {
+	first, second := new(fakeProvider), new(fakeProvider)
+	a := first.addKey(t, "a", false)
+	b := second.addKey(t, "b", false)
+	ag := NewComposedAgent(first, second)
+
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "a" || keys[1].Comment != "b" {
+		t.Fatalf("List() = %v, want a and b in provider order", keys)
+	}
+
+	data := []byte("data")
+	for _, tt := range []struct {
+		key   ssh.PublicKey
+		owner *fakeProvider
+	}{{a, first}, {b, second}} {
+		signed := tt.owner.signed
+		sig, err := ag.Sign(tt.key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.key.Verify(data, sig); err != nil {
+			t.Error(err)
+		}
+		if tt.owner.signed != signed+1 {
+			t.Error("signature not made by the provider of the key")
+		}
+	}
+
+	other := new(fakeProvider)
+	if _, err := ag.Sign(other.addKey(t, "c", false), data); err == nil {
+		t.Error("signed with an unknown key")
+	}
+}
+
+func TestComposedAgentDuplicateKey(t *testing.T) {
+	first, second := new(fakeProvider), new(fakeProvider)
+	key := first.addKey(t, "first", false)
+	second.share(first.signers[string(key.Marshal())], "second", false)
+	ag := NewComposedAgent(first, second)
+
+	if _, err := ag.List(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if first.signed != 1 || second.signed != 0 {
+		t.Errorf("signatures: first %d, second %d, want the first provider to own the key", first.signed, second.signed)
+	}
+}
+
+func TestComposedAgentFailingProvider(t *testing.T) {
+	failing, working := &fakeProvider{err: errors.New("token removed")}, new(fakeProvider)
+	key := working.addKey(t, "working", false)
+	ag := NewComposedAgent(failing, working)
+
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "working" {
+		t.Fatalf("List() = %v, want the keys of the working provider", keys)
+	}
+	if _, err := ag.Sign(key, []byte("data")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestComposedAgentSlowProvider(t *testing.T) {
+	slow, fast := new(fakeProvider), new(fakeProvider)
+	slow.addKey(t, "slow", false)
+	key := fast.addKey(t, "fast", false)
+	ag := NewComposedAgent(slow, fast)
+	if _, err := ag.List(); err != nil {
+		t.Fatal(err)
+	}
+
+	slow.block = make(chan struct{})
+	listed := make(chan error)
+	go func() {
+		_, err := ag.Extension(listExtendedExtension, nil)
+		listed <- err
+	}()
+	signed := make(chan error)
+	go func() {
+		_, err := ag.Sign(key, []byte("data"))
+		signed <- err
+	}()
+	select {
+	case err := <-signed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Sign() blocked by a pending list-extended request")
+	}
+	close(slow.block)
+	if err := <-listed; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestComposedAgentLock(t *testing.T) {
+	p := new(fakeProvider)
+	key := p.addKey(t, "a", false)
+	ag := NewComposedAgent(p)
+
+	if err := ag.Lock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.locked, []byte("secret")) {
+		t.Error("provider not locked with the passphrase")
+	}
+	if err := ag.Lock([]byte("secret")); err == nil {
+		t.Error("locked a locked agent")
+	}
+	if keys, err := ag.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List() of a locked agent = %v, %v, want no keys", keys, err)
+	}
+	if _, err := ag.Sign(key, []byte("data")); err == nil {
+		t.Error("signed with a locked agent")
+	}
+	if err := ag.Add(agent.AddedKey{}); err == nil {
+		t.Error("added a key to a locked agent")
+	}
+	if err := ag.Remove(key); err == nil {
+		t.Error("removed a key of a locked agent")
+	}
+	if err := ag.RemoveAll(); err == nil {
+		t.Error("removed all keys of a locked agent")
+	}
+	if p.removed != 0 {
+		t.Error("removal reached the provider of a locked agent")
+	}
+	if err := ag.Unlock([]byte("wrong")); err == nil {
+		t.Error("unlocked with a wrong passphrase")
+	}
+	if err := ag.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if p.locked != nil {
+		t.Error("provider not unlocked")
+	}
+	if _, err := ag.Sign(key, []byte("data")); err != nil {
+		t.Error(err)
+	}
+	if err := ag.Unlock([]byte("secret")); err == nil {
+		t.Error("unlocked an agent which is not locked")
+	}
+}
+
+func TestComposedAgentConfirm(t *testing.T) {
+	allow := false
+	var asked []string
+	defer func(confirm func(string) bool) { confirmKeyUse = confirm }(confirmKeyUse)
+	confirmKeyUse = func(message string) bool {
+		asked = append(asked, message)
+		return allow
+	}
+
+	p := new(fakeProvider)
+	confirmed := p.addKey(t, "confirmed", true)
+	plain := p.addKey(t, "plain", false)
+	ag := NewComposedAgent(p)
+
+	if _, err := ag.Sign(plain, []byte("data")); err != nil || len(asked) != 0 {
+		t.Fatalf("Sign() = %v, asked %v, want a signature without asking", err, asked)
+	}
+	if _, err := ag.Sign(confirmed, []byte("data")); err == nil {
+		t.Error("signed although the use was denied")
+	}
+	if p.signed != 1 {
+		t.Error("provider asked to sign although the use was denied")
+	}
+	allow = true
+	if _, err := ag.Sign(confirmed, []byte("data")); err != nil {
+		t.Error(err)
+	}
+	if len(asked) != 2 {
+		t.Errorf("asked %d times, want 2", len(asked))
+	}
+}
+
+func TestComposedAgentAddRemove(t *testing.T) {
+	first, second := new(fakeProvider), new(fakeProvider)
+	key := first.addKey(t, "a", false)
+	ag := NewComposedAgent(first, second)
+
+	if err := ag.Add(agent.AddedKey{Comment: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.added) != 1 || len(second.added) != 0 {
+		t.Error("added key not taken by the first provider")
+	}
+	if err := ag.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if first.removed != 2 || second.removed != 1 {
+		t.Errorf("removals: first %d, second %d, want 2 and 1", first.removed, second.removed)
+	}
+}
+
+// tempHome points the user profile folder to a new folder, so the audit log of a test is not kept.
+func tempHome(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := os.Getenv("USERPROFILE")
+	os.Setenv("USERPROFILE", dir)
+	t.Cleanup(func() {
+		os.Setenv("USERPROFILE", home)
+		os.RemoveAll(dir)
+	})
+}
+
+func TestClientAgentRestricted(t *testing.T) {
+	tempHome(t)
+	p := new(fakeProvider)
+	shown := p.addKey(t, "shown", false)
+	hidden := p.addKey(t, "hidden", false)
+	ag := NewComposedAgent(p)
+	client := ag.ForClient("vm", func(key *ProviderKey) bool { return key.Comment == "shown" })
+
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "shown" {
+		t.Fatalf("List() = %v, want only the shown key", keys)
+	}
+	if _, err := client.Sign(shown, []byte("data")); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.Sign(hidden, []byte("data")); err == nil {
+		t.Error("client signed with a key it cannot see")
+	}
+	if err := client.Add(agent.AddedKey{}); err == nil {
+		t.Error("restricted client added a key")
+	}
+	if err := client.Remove(hidden); err == nil {
+		t.Error("restricted client removed a key")
+	}
+	if err := client.RemoveAll(); err == nil {
+		t.Error("restricted client removed all keys")
+	}
+	if err := client.Lock([]byte("secret")); err == nil {
+		t.Error("restricted client locked the agent")
+	}
+	if len(p.added) != 0 || p.removed != 0 || p.locked != nil {
+		t.Error("request of a restricted client reached the provider")
+	}
+
+	if err := ag.ForClient("vm", nil).RemoveAll(); err != nil || p.removed != 1 {
+		t.Errorf("RemoveAll() of an unrestricted client = %v, want the keys removed", err)
+	}
+}
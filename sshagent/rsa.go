@@ -1,6 +1,10 @@
 package sshagent
 
 import (
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
@@ -22,17 +26,30 @@ func (s *rsaSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
 
 func (s *rsaSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
 	capiAlg := ""
+	var hash crypto.Hash
 	switch algorithm {
 	case "", ssh.SigAlgoRSA:
 		algorithm = ssh.SigAlgoRSA
 		capiAlg = capi.ALG_RSA_SHA1RSA
+		hash = crypto.SHA1
 	case ssh.SigAlgoRSASHA2256:
 		capiAlg = capi.ALG_RSA_SHA256RSA
+		hash = crypto.SHA256
 	case ssh.SigAlgoRSASHA2512:
 		capiAlg = capi.ALG_RSA_SHA512RSA
+		hash = crypto.SHA512
 	default:
 		return nil, fmt.Errorf("ssh: unsupported signature algorithm %s", algorithm)
 	}
+	if sig, err := s.cert.SignHash(hashData(hash, data), hash); err != capi.ErrNotNCryptKey {
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Signature{
+			Format: algorithm,
+			Blob:   sig,
+		}, nil
+	}
 	p7, err := capi.Sign(capiAlg, s.cert, data)
 	if err != nil || len(p7.Signers) < 1 {
 		return nil, err
@@ -42,3 +59,9 @@ func (s *rsaSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm str
 		Blob:   p7.Signers[0].EncryptedDigest,
 	}, nil
 }
+
+func hashData(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
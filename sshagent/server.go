@@ -1,12 +1,113 @@
 package sshagent
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/buptczq/WinCryptSSHAgent/agentproto"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"io"
+	"net"
+	"strings"
+	"sync"
 )
 
+// agent messages, ssh-add -s and -e are not handled by agent.ServeAgent
+const (
+	agentFailure                    = 5
+	agentSuccess                    = 6
+	agentAddIdentity                = 17
+	agentRemoveIdentity             = 18
+	agentRemoveAllIdentities        = 19
+	agentLock                       = 22
+	agentUnlock                     = 23
+	agentAddIDConstrained           = 25
+	agentExtension                  = 27
+	agentAddSmartcardKey            = 20
+	agentRemoveSmartcardKey         = 21
+	agentAddSmartcardKeyConstrained = 26
+
+	agentConstrainLifetime = 1
+	agentConstrainConfirm  = 2
+)
+
+// SmartcardAgent is implemented by agents which load PKCS #11 modules for ssh-add -s and unload them for ssh-add -e.
+type SmartcardAgent interface {
+	AddSmartcardKey(reader, pin string, lifetimeSecs uint32, confirm bool) error
+	RemoveSmartcardKey(reader, pin string) error
+}
+
 type Server struct {
 	Agent agent.Agent
+	// GuestReadOnly refuses requests from Hyper-V guests and WSL2 which add, remove or lock keys.
+	GuestReadOnly bool
+	// VMAccess decides which virtual machines may use the agent, all of them if nil.
+	VMAccess *VMAccess
+}
+
+var vmNames sync.Map
+
+// guestVM returns the virtual machine of a Hyper-V socket.
+func guestVM(conn io.ReadWriter) *VM {
+	addr := conn.(interface{ RemoteAddr() net.Addr }).RemoteAddr().String()
+	vm := &VM{ID: strings.ToLower(strings.SplitN(addr, ":", 2)[0])}
+	if name, ok := vmNames.Load(vm.ID); ok {
+		vm.Name = name.(string)
+	} else {
+		vm.Name = utils.VMName(vm.ID)
+		vmNames.Store(vm.ID, vm.Name)
+	}
+	return vm
+}
+
+// clientAgent returns the agent serving conn, virtual machines only see the keys they are allowed to.
+// restricted is set for virtual machines which do not see all keys, they may not change keys.
+func (s *Server) clientAgent(conn io.ReadWriter) (ag agent.Agent, restricted bool, err error) {
+	if !guestConn(conn) {
+		return s.Agent, false, nil
+	}
+	vm := guestVM(conn)
+	var visible func(*ProviderKey) bool
+	if s.VMAccess != nil {
+		rule := s.VMAccess.authorize(vm)
+		if rule == nil {
+			return nil, false, errors.New("agent: access denied for " + vm.String())
+		}
+		if rule.keys != nil {
+			visible = rule.visible
+		}
+	}
+	if composed, ok := s.Agent.(*ComposedAgent); ok {
+		return composed.ForClient(vm.String(), visible), visible != nil, nil
+	}
+	if visible != nil {
+		return nil, false, errors.New("agent: keys of " + vm.String() + " cannot be restricted")
+	}
+	return s.Agent, false, nil
+}
+
+// guestConn reports whether conn is a Hyper-V socket from a virtual machine.
+func guestConn(conn io.ReadWriter) bool {
+	c, ok := conn.(interface{ RemoteAddr() net.Addr })
+	return ok && c.RemoteAddr().Network() == "hvsock"
+}
+
+func changesKeys(req []byte) bool {
+	switch req[0] {
+	case agentAddIdentity, agentAddIDConstrained, agentRemoveIdentity, agentRemoveAllIdentities,
+		agentLock, agentUnlock,
+		agentAddSmartcardKey, agentRemoveSmartcardKey, agentAddSmartcardKeyConstrained:
+		return true
+	case agentExtension:
+		var msg struct {
+			ExtensionType string
+			Contents      []byte `ssh:"rest"`
+		}
+		return ssh.Unmarshal(req[1:], &msg) == nil && msg.ExtensionType == addPPKExtension
+	}
+	return false
 }
 
 func (s *Server) SSHAgentHandler(conn io.ReadWriteCloser) {
@@ -14,8 +115,93 @@ func (s *Server) SSHAgentHandler(conn io.ReadWriteCloser) {
 	if s.Agent == nil {
 		return
 	}
-	err := agent.ServeAgent(s.Agent, conn)
+	err := s.serve(conn)
 	if err != nil && err != io.EOF {
 		println(err.Error())
 	}
 }
+
+func (s *Server) serve(conn io.ReadWriter) error {
+	ag, restricted, err := s.clientAgent(conn)
+	if err != nil {
+		return err
+	}
+	readOnly := restricted || s.GuestReadOnly && guestConn(conn)
+	for {
+		req, err := agentproto.ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		var reply []byte
+		switch {
+		case readOnly && changesKeys(req):
+			reply = []byte{agentFailure}
+		case req[0] == agentAddSmartcardKey || req[0] == agentRemoveSmartcardKey || req[0] == agentAddSmartcardKeyConstrained:
+			reply = s.smartcard(req)
+		default:
+			// every other message is one request for agent.ServeAgent
+			in := new(bytes.Buffer)
+			agentproto.WriteMessage(in, req)
+			out := new(bytes.Buffer)
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{in, out}
+			if err := agent.ServeAgent(ag, rw); err != io.EOF {
+				return err
+			}
+			if _, err := conn.Write(out.Bytes()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := agentproto.WriteMessage(conn, reply); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) smartcard(req []byte) []byte {
+	sc, ok := s.Agent.(SmartcardAgent)
+	if !ok {
+		return []byte{agentFailure}
+	}
+	var msg struct {
+		Reader      string
+		PIN         string
+		Constraints []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(req[1:], &msg); err != nil {
+		return []byte{agentFailure}
+	}
+
+	var err error
+	if req[0] == agentRemoveSmartcardKey {
+		err = sc.RemoveSmartcardKey(msg.Reader, msg.PIN)
+	} else {
+		var lifetime uint32
+		var confirm bool
+		for c := msg.Constraints; len(c) > 0 && err == nil; {
+			switch {
+			case c[0] == agentConstrainLifetime && len(c) >= 5:
+				lifetime = binary.BigEndian.Uint32(c[1:5])
+				c = c[5:]
+			case c[0] == agentConstrainConfirm:
+				confirm = true
+				c = c[1:]
+			default:
+				err = errors.New("agent: unsupported constraint")
+			}
+		}
+		if err == nil {
+			err = sc.AddSmartcardKey(msg.Reader, msg.PIN, lifetime, confirm)
+		}
+	}
+	if err != nil {
+		println("smartcard error:", err.Error())
+		return []byte{agentFailure}
+	}
+	return []byte{agentSuccess}
+}
@@ -0,0 +1,121 @@
+package sshagent
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	DefaultUpstreamTimeout = 5 * time.Second
+	// DefaultUpstreamSignTimeout leaves time for the PIN or confirmation prompts of the upstream agent.
+	DefaultUpstreamSignTimeout = 5 * time.Minute
+)
+
+// UpstreamAgent serves the keys of another running agent, e.g. Gpg4win or KeeAgent.
+//
+// An upstream is written as <name>=<address>, the address is a named pipe \\.\pipe\<name>,
+// unix:<path> for a Unix domain socket or tcp:<host>:<port>.
+type UpstreamAgent struct {
+	Name    string
+	Network string
+	Address string
+	// Timeout limits dialing and listing keys, DefaultUpstreamTimeout if zero.
+	Timeout time.Duration
+	// SignTimeout limits sign requests, DefaultUpstreamSignTimeout if zero.
+	SignTimeout time.Duration
+}
+
+func ParseUpstream(spec string) (*UpstreamAgent, error) {
+	kv := strings.SplitN(spec, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return nil, fmt.Errorf("upstream: invalid upstream %s, expected <name>=<address>", spec)
+	}
+	upstream := &UpstreamAgent{Name: kv[0]}
+	address := kv[1]
+	switch {
+	case strings.HasPrefix(address, `\\.\pipe\`):
+		upstream.Network, upstream.Address = "pipe", address
+	case strings.HasPrefix(address, "pipe:"):
+		upstream.Network, upstream.Address = "pipe", strings.TrimPrefix(address, "pipe:")
+	case strings.HasPrefix(address, "unix:"):
+		upstream.Network, upstream.Address = "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "tcp:"):
+		upstream.Network, upstream.Address = "tcp", strings.TrimPrefix(address, "tcp:")
+	default:
+		return nil, fmt.Errorf("upstream: unknown address %s", address)
+	}
+	return upstream, nil
+}
+
+func (s *UpstreamAgent) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultUpstreamTimeout
+}
+
+func (s *UpstreamAgent) signTimeout() time.Duration {
+	if s.SignTimeout > 0 {
+		return s.SignTimeout
+	}
+	return DefaultUpstreamSignTimeout
+}
+
+// dial connects to the upstream agent, requests on the connection must end before the deadline.
+func (s *UpstreamAgent) dial(deadline time.Duration) (net.Conn, error) {
+	timeout := s.timeout()
+	var conn net.Conn
+	var err error
+	if s.Network == "pipe" {
+		conn, err = winio.DialPipe(s.Address, &timeout)
+	} else {
+		conn, err = net.DialTimeout(s.Network, s.Address, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %v", s.Name, err)
+	}
+	conn.SetDeadline(time.Now().Add(deadline))
+	return conn, nil
+}
+
+// Keys lists the keys of the upstream agent, an unreachable upstream has no keys.
+func (s *UpstreamAgent) Keys() ([]*ProviderKey, error) {
+	conn, err := s.dial(s.timeout())
+	if err != nil {
+		println(err.Error())
+		return nil, nil
+	}
+	defer conn.Close()
+	ids, err := agent.NewClient(conn).List()
+	if err != nil {
+		println("upstream", s.Name, "error:", err.Error())
+		return nil, nil
+	}
+	keys := make([]*ProviderKey, 0, len(ids))
+	for _, id := range ids {
+		pub, err := ssh.ParsePublicKey(id.Blob)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, &ProviderKey{
+			PublicKey: pub,
+			Comment:   "[" + s.Name + "] " + id.Comment,
+		})
+	}
+	return keys, nil
+}
+
+func (s *UpstreamAgent) SignWithAlgorithm(key ssh.PublicKey, data []byte, algorithm string) (*ssh.Signature, error) {
+	conn, err := s.dial(s.signTimeout())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return agent.NewClient(conn).SignWithFlags(key, data, signatureFlags(algorithm))
+}
@@ -0,0 +1,208 @@
+package sshagent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Microsoft/go-winio/pkg/guid"
+	"github.com/buptczq/WinCryptSSHAgent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const vmAccessFile = "wincrypt-vm-access"
+
+// VM is a virtual machine connected with a Hyper-V socket.
+type VM struct {
+	ID   string
+	Name string
+}
+
+func (vm *VM) String() string {
+	if vm.Name == "" {
+		return vm.ID
+	}
+	return vm.Name + " (" + vm.ID + ")"
+}
+
+type vmRule struct {
+	// keys are comments or SHA256 fingerprints, nil for all keys
+	keys []string
+}
+
+func (r *vmRule) visible(key *ProviderKey) bool {
+	if r.keys == nil {
+		return true
+	}
+	fp := ssh.FingerprintSHA256(key.PublicKey)
+	for _, k := range r.keys {
+		if k == key.Comment || k == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// VMAccess decides which virtual machines may use the agent and which keys they see.
+//
+// Virtual machines without a rule are allowed or denied with a prompt on their first connection,
+// the answer is remembered in the user profile folder by the ID of the virtual machine. Names are
+// only matched by rules, a new virtual machine with the name of another one is asked about again.
+type VMAccess struct {
+	mu        sync.Mutex
+	rules     map[string]*vmRule
+	decisions map[string]bool
+	// prompts are closed once the pending prompt for a virtual machine is answered
+	prompts map[string]chan struct{}
+}
+
+// AddRule allows a virtual machine, written as <vm>[=<key>;<key>...] with a VM ID or name
+// and the comments or SHA256 fingerprints of the keys it sees.
+func (a *VMAccess) AddRule(spec string) error {
+	kv := strings.SplitN(spec, "=", 2)
+	vm := strings.ToLower(strings.TrimSpace(kv[0]))
+	if vm == "" {
+		return fmt.Errorf("vm: invalid rule %s", spec)
+	}
+	rule := &vmRule{}
+	if len(kv) == 2 {
+		rule.keys = make([]string, 0)
+		for _, key := range strings.Split(kv[1], ";") {
+			if key = strings.TrimSpace(key); key != "" {
+				rule.keys = append(rule.keys, key)
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rules == nil {
+		a.rules = make(map[string]*vmRule)
+	}
+	a.rules[vm] = rule
+	return nil
+}
+
+func (a *VMAccess) loadDecisions() {
+	if a.decisions != nil {
+		return
+	}
+	a.decisions = make(map[string]bool)
+	path, err := certFilePath(vmAccessFile)
+	if err != nil {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// decisions by name of older versions are dropped
+		if _, err := guid.FromString(fields[0]); err != nil {
+			continue
+		}
+		a.decisions[strings.ToLower(fields[0])] = fields[1] == "allow"
+	}
+}
+
+func (a *VMAccess) saveDecisions() error {
+	path, err := certFilePath(vmAccessFile)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for id, allowed := range a.decisions {
+		decision := "deny"
+		if allowed {
+			decision = "allow"
+		}
+		if _, err := file.WriteString(id + " " + decision + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorize returns the rule of a virtual machine, or nil if it may not use the agent.
+// The prompt is shown without holding the lock, other connections wait only for a prompt about the same virtual machine.
+func (a *VMAccess) authorize(vm *VM) *vmRule {
+	a.mu.Lock()
+	if rule, ok := a.rules[strings.ToLower(vm.ID)]; ok {
+		a.mu.Unlock()
+		return rule
+	}
+	if rule, ok := a.rules[strings.ToLower(vm.Name)]; ok && vm.Name != "" {
+		a.mu.Unlock()
+		return rule
+	}
+
+	a.loadDecisions()
+	key := strings.ToLower(vm.ID)
+	for {
+		if allowed, ok := a.decisions[key]; ok {
+			a.mu.Unlock()
+			if !allowed {
+				return nil
+			}
+			return &vmRule{}
+		}
+		wait, ok := a.prompts[key]
+		if !ok {
+			break
+		}
+		a.mu.Unlock()
+		<-wait
+		a.mu.Lock()
+	}
+	if a.prompts == nil {
+		a.prompts = make(map[string]chan struct{})
+	}
+	done := make(chan struct{})
+	a.prompts[key] = done
+	a.mu.Unlock()
+
+	answer := utils.MessageBox(
+		"Confirm:",
+		"Allow virtual machine <"+vm.String()+"> to use the agent?\n\nYes and No are remembered, Cancel only refuses this connection.",
+		utils.MB_YESNOCANCEL|utils.MB_ICONQUESTION,
+	)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.prompts, key)
+	close(done)
+
+	var allowed bool
+	switch answer {
+	case utils.IDYES:
+		allowed = true
+	case utils.IDNO:
+		allowed = false
+	default:
+		utils.Audit("vm: refused connection of %s", vm)
+		return nil
+	}
+	a.decisions[key] = allowed
+	if err := a.saveDecisions(); err != nil {
+		println("vm access error:", err.Error())
+	}
+	if !allowed {
+		utils.Audit("vm: denied %s", vm)
+		return nil
+	}
+	utils.Audit("vm: allowed %s", vm)
+	return &vmRule{}
+}
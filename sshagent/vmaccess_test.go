@@ -0,0 +1,35 @@
+package sshagent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVMAccessDecisions(t *testing.T) {
+	tempHome(t)
+	data := "build-vm allow\r\n" +
+		"0F6D2E5C-1A3B-4C5D-8E9F-0A1B2C3D4E5F allow\r\n" +
+		"1f6d2e5c-1a3b-4c5d-8e9f-0a1b2c3d4e5f deny\r\n"
+	if err := ioutil.WriteFile(filepath.Join(os.Getenv("USERPROFILE"), vmAccessFile), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(VMAccess)
+	if err := a.AddRule("Named-VM=alice"); err != nil {
+		t.Fatal(err)
+	}
+	if rule := a.authorize(&VM{ID: "0f6d2e5c-1a3b-4c5d-8e9f-0a1b2c3d4e5f", Name: "build-vm"}); rule == nil || rule.keys != nil {
+		t.Errorf("authorize() of an allowed VM = %v", rule)
+	}
+	if rule := a.authorize(&VM{ID: "1f6d2e5c-1a3b-4c5d-8e9f-0a1b2c3d4e5f", Name: "build-vm"}); rule != nil {
+		t.Errorf("authorize() of a denied VM with the name of an allowed one = %v", rule)
+	}
+	if rule := a.authorize(&VM{ID: "2f6d2e5c-1a3b-4c5d-8e9f-0a1b2c3d4e5f", Name: "named-vm"}); rule == nil || len(rule.keys) != 1 {
+		t.Errorf("authorize() of a VM with a rule = %v", rule)
+	}
+	if _, ok := a.decisions["build-vm"]; ok {
+		t.Error("decision by name was loaded")
+	}
+}
@@ -0,0 +1,134 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// RFC 6187 public key algorithms
+const (
+	KeyAlgoX509v3RSA       = "x509v3-ssh-rsa"
+	KeyAlgoX509v3RSASHA256 = "x509v3-rsa2048-sha256"
+	KeyAlgoX509v3ECDSA256  = "x509v3-ecdsa-sha2-nistp256"
+	KeyAlgoX509v3ECDSA384  = "x509v3-ecdsa-sha2-nistp384"
+	KeyAlgoX509v3ECDSA521  = "x509v3-ecdsa-sha2-nistp521"
+
+	sigAlgoRSA2048SHA256 = "rsa2048-sha256"
+)
+
+// x509v3PublicKey is an X.509 certificate chain in the RFC 6187 format.
+type x509v3PublicKey struct {
+	algo  string
+	key   ssh.PublicKey
+	chain []*x509.Certificate
+	ocsp  [][]byte
+}
+
+func (k *x509v3PublicKey) Type() string {
+	return k.algo
+}
+
+func (k *x509v3PublicKey) Marshal() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(ssh.Marshal(struct{ Name string }{k.algo}))
+	buf.Write(ssh.Marshal(struct{ N uint32 }{uint32(len(k.chain))}))
+	for _, cert := range k.chain {
+		buf.Write(ssh.Marshal(struct{ Cert []byte }{cert.Raw}))
+	}
+	buf.Write(ssh.Marshal(struct{ N uint32 }{uint32(len(k.ocsp))}))
+	for _, resp := range k.ocsp {
+		buf.Write(ssh.Marshal(struct{ Resp []byte }{resp}))
+	}
+	return buf.Bytes()
+}
+
+func (k *x509v3PublicKey) Verify(data []byte, sig *ssh.Signature) error {
+	if sig.Format == sigAlgoRSA2048SHA256 {
+		sig = &ssh.Signature{Format: ssh.SigAlgoRSASHA2256, Blob: sig.Blob}
+	}
+	return k.key.Verify(data, sig)
+}
+
+// x509v3Signer signs for an RFC 6187 identity with the key of its end-entity certificate.
+type x509v3Signer struct {
+	pub    *x509v3PublicKey
+	signer ssh.Signer
+}
+
+func (s *x509v3Signer) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *x509v3Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if s.pub.algo != KeyAlgoX509v3RSASHA256 {
+		return s.signer.Sign(rand, data)
+	}
+	algorithmSigner, ok := s.signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("agent: signature does not support non-default signature algorithm: %T", s.signer)
+	}
+	sig, err := algorithmSigner.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2256)
+	if err != nil {
+		return nil, err
+	}
+	sig.Format = sigAlgoRSA2048SHA256
+	return sig, nil
+}
+
+// certificateChain returns the certificate followed by its issuers, without the self-signed root.
+func certificateChain(cert *x509.Certificate) []*x509.Certificate {
+	chains, err := cert.Verify(x509.VerifyOptions{
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil || len(chains) == 0 {
+		return []*x509.Certificate{cert}
+	}
+	chain := chains[0]
+	if len(chain) > 1 {
+		root := chain[len(chain)-1]
+		if bytes.Equal(root.RawIssuer, root.RawSubject) {
+			chain = chain[:len(chain)-1]
+		}
+	}
+	return chain
+}
+
+func loadX509v3Key(key *sshKey) (*sshKey, error) {
+	pub := &x509v3PublicKey{
+		key:   key.signer.PublicKey(),
+		chain: certificateChain(key.cert.Certificate),
+	}
+	switch pub.key.Type() {
+	case ssh.KeyAlgoRSA:
+		if key.cert.PublicKey.(*rsa.PublicKey).N.BitLen() >= 2048 {
+			pub.algo = KeyAlgoX509v3RSASHA256
+		} else {
+			pub.algo = KeyAlgoX509v3RSA
+		}
+	case ssh.KeyAlgoECDSA256:
+		pub.algo = KeyAlgoX509v3ECDSA256
+	case ssh.KeyAlgoECDSA384:
+		pub.algo = KeyAlgoX509v3ECDSA384
+	case ssh.KeyAlgoECDSA521:
+		pub.algo = KeyAlgoX509v3ECDSA521
+	default:
+		return nil, errors.New("unsupported x509v3 key type")
+	}
+	newX509Cert, err := key.cert.Copy()
+	if err != nil {
+		return nil, err
+	}
+	return &sshKey{
+		cert: newX509Cert,
+		signer: &x509v3Signer{
+			pub:    pub,
+			signer: key.signer,
+		},
+		comment: key.comment,
+	}, nil
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const auditLogFile = "WCSA_AUDIT.log"
+
+var auditMu sync.Mutex
+
+// Audit appends a timestamped line to the audit log in the user profile folder.
+func Audit(format string, a ...interface{}) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(home, auditLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\r\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, a...))
+	return err
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modcredui                       = syscall.NewLazyDLL("credui.dll")
+	procCredUIPromptForCredentialsW = modcredui.NewProc("CredUIPromptForCredentialsW")
+)
+
+const (
+	CREDUI_FLAGS_DO_NOT_PERSIST      = 0x00000002
+	CREDUI_FLAGS_ALWAYS_SHOW_UI      = 0x00000080
+	CREDUI_FLAGS_GENERIC_CREDENTIALS = 0x00040000
+	CREDUI_FLAGS_KEEP_USERNAME       = 0x00100000
+	CREDUI_FLAGS_INCORRECT_PASSWORD  = 0x00000001
+	CREDUI_MAX_USERNAME_LENGTH       = 513
+	CREDUI_MAX_PASSWORD_LENGTH       = 256
+	ERROR_CANCELLED                  = syscall.Errno(1223)
+)
+
+// ErrCancelled is returned by PasswordPrompt when the user closes the dialog.
+var ErrCancelled = errors.New("cancelled by user")
+
+type credUIInfo struct {
+	cbSize         uint32
+	hwndParent     uintptr
+	pszMessageText *uint16
+	pszCaptionText *uint16
+	hbmBanner      uintptr
+}
+
+// PasswordPrompt asks for a password with the Windows credential dialog, name is shown read-only.
+func PasswordPrompt(caption, message, name string, retry bool) (string, error) {
+	captionPtr, _ := syscall.UTF16PtrFromString(caption)
+	messagePtr, _ := syscall.UTF16PtrFromString(message)
+	targetPtr, _ := syscall.UTF16PtrFromString(name)
+	info := credUIInfo{
+		pszMessageText: messagePtr,
+		pszCaptionText: captionPtr,
+	}
+	info.cbSize = uint32(unsafe.Sizeof(info))
+
+	user := make([]uint16, CREDUI_MAX_USERNAME_LENGTH+1)
+	copy(user, syscall.StringToUTF16(name))
+	password := make([]uint16, CREDUI_MAX_PASSWORD_LENGTH+1)
+	defer func() {
+		for i := range password {
+			password[i] = 0
+		}
+	}()
+	save := int32(0)
+	flags := uint32(CREDUI_FLAGS_GENERIC_CREDENTIALS | CREDUI_FLAGS_KEEP_USERNAME | CREDUI_FLAGS_ALWAYS_SHOW_UI | CREDUI_FLAGS_DO_NOT_PERSIST)
+	if retry {
+		flags |= CREDUI_FLAGS_INCORRECT_PASSWORD
+	}
+	r0, _, _ := syscall.Syscall12(procCredUIPromptForCredentialsW.Addr(), 10,
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Pointer(targetPtr)),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&user[0])),
+		uintptr(len(user)),
+		uintptr(unsafe.Pointer(&password[0])),
+		uintptr(len(password)),
+		uintptr(unsafe.Pointer(&save)),
+		uintptr(flags),
+		0,
+		0,
+	)
+	switch syscall.Errno(r0) {
+	case 0:
+		return syscall.UTF16ToString(password), nil
+	case ERROR_CANCELLED:
+		return "", ErrCancelled
+	}
+	return "", syscall.Errno(r0)
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32            = windows.NewLazySystemDLL("Advapi32.dll")
+	crypt32             = windows.NewLazySystemDLL("Crypt32.dll")
+	pGetUserName        = advapi32.NewProc("GetUserNameW")
+	pCryptProtectMemory = crypt32.NewProc("CryptProtectMemory")
+)
+
+const (
+	cryptProtectMemoryBlockSize    = 16
+	cryptProtectMemoryCrossProcess = 1
+)
+
+// pageantUserName returns the user name as PuTTY does, the user principal name without
+// the domain if there is one, the local user name otherwise.
+func pageantUserName() (string, error) {
+	buf := make([]uint16, 256)
+	n := uint32(len(buf))
+	if err := windows.GetUserNameEx(windows.NameUserPrincipal, &buf[0], &n); err == nil {
+		return strings.SplitN(windows.UTF16ToString(buf[:n]), "@", 2)[0], nil
+	}
+	n = uint32(len(buf))
+	r, _, err := pGetUserName.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)))
+	if r == 0 {
+		return "", err
+	}
+	return windows.UTF16ToString(buf), nil
+}
+
+// obfuscatePageantName encrypts name with CryptProtectMemory for all processes of the
+// current logon session and returns the hex SHA-256 hash of the result as an SSH string.
+func obfuscatePageantName(name string) (string, error) {
+	size := (len(name) + 1 + cryptProtectMemoryBlockSize - 1) / cryptProtectMemoryBlockSize * cryptProtectMemoryBlockSize
+	data := make([]byte, size)
+	copy(data, name)
+	r, _, err := pCryptProtectMemory.Call(uintptr(unsafe.Pointer(&data[0])), uintptr(size), cryptProtectMemoryCrossProcess)
+	if r == 0 {
+		return "", err
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(size))
+	h := sha256.New()
+	h.Write(length[:])
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PageantPipeName returns the named pipe of Pageant used by PuTTY 0.75 and later,
+// \\.\pipe\pageant.<user>.<obfuscated name>.
+func PageantPipeName() (string, error) {
+	user, err := pageantUserName()
+	if err != nil {
+		return "", err
+	}
+	suffix, err := obfuscatePageantName("Pageant")
+	if err != nil {
+		return "", err
+	}
+	return `\\.\pipe\pageant.` + user + "." + suffix, nil
+}
+
+// PageantPipeSecurityDescriptor returns a security descriptor in SDDL format
+// which only gives the current user access to the pipe.
+func PageantPipeSecurityDescriptor() (string, error) {
+	sid, err := GetUserSID()
+	if err != nil {
+		return "", err
+	}
+	return "O:" + sid.String() + "D:P(A;;GA;;;" + sid.String() + ")", nil
+}
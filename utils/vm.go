@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/bi-zone/wmi"
+	"github.com/buptczq/WinCryptSSHAgent/vmlist"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modvmcompute                   = syscall.NewLazyDLL("vmcompute.dll")
+	procHcsEnumerateComputeSystems = modvmcompute.NewProc("HcsEnumerateComputeSystems")
+)
+
+const hyperVNamespace = `root\virtualization\v2`
+
+// computeSystemsError reports once that the compute service cannot be queried.
+var computeSystemsError sync.Once
+
+const vmEventQuery = `
+SELECT * FROM __InstanceOperationEvent
+WITHIN 2
+WHERE
+TargetInstance ISA 'Msvm_ComputerSystem'`
+
+func computeSystems() ([]vmlist.VMInfo, error) {
+	if err := procHcsEnumerateComputeSystems.Find(); err != nil {
+		return nil, err
+	}
+	query, err := syscall.UTF16PtrFromString("{}")
+	if err != nil {
+		return nil, err
+	}
+	var systems, result *uint16
+	r0, _, _ := procHcsEnumerateComputeSystems.Call(
+		uintptr(unsafe.Pointer(query)),
+		uintptr(unsafe.Pointer(&systems)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	if result != nil {
+		windows.CoTaskMemFree(unsafe.Pointer(result))
+	}
+	if r0 != 0 {
+		return nil, syscall.Errno(r0)
+	}
+	if systems == nil {
+		return nil, nil
+	}
+	data := windows.UTF16PtrToString(systems)
+	windows.CoTaskMemFree(unsafe.Pointer(systems))
+	return vmlist.ParseComputeSystems([]byte(data))
+}
+
+// hyperVNames returns the names of the running Hyper-V virtual machines by VM ID.
+func hyperVNames() map[string]string {
+	type Msvm_ComputerSystem struct {
+		Name        string
+		ElementName string
+	}
+	var systems []Msvm_ComputerSystem
+	names := make(map[string]string)
+	q := wmi.CreateQuery(&systems, "WHERE Caption='Virtual Machine' AND EnabledState=2")
+	if err := wmi.QueryNamespace(q, &systems, hyperVNamespace); err != nil {
+		return names
+	}
+	for _, s := range systems {
+		names[strings.ToLower(s.Name)] = s.ElementName
+	}
+	return names
+}
+
+// RunningVMs lists the running virtual machines. WSL2 is found from the command lines of wslhost.exe,
+// which needs no privileges. The compute service, which needs an administrator or a member of
+// Hyper-V Administrators, adds other utility VMs, and the WMI virtualization namespace adds the
+// Hyper-V virtual machines and their names.
+func RunningVMs() []vmlist.VMInfo {
+	systems, err := computeSystems()
+	if err != nil {
+		computeSystemsError.Do(func() {
+			println("compute service error:", err.Error())
+		})
+	}
+	return vmlist.Merge(wslHostVMIDs(), systems, hyperVNames())
+}
+
+// VMName returns the name of a running virtual machine, "WSL" for WSL2,
+// or an empty string if the name cannot be found.
+func VMName(vmid string) string {
+	for _, vm := range RunningVMs() {
+		if strings.EqualFold(vm.ID, vmid) {
+			return vm.Name
+		}
+	}
+	return ""
+}
+
+// VMEvent is sent when a virtual machine starts or stops.
+type VMEvent struct {
+	VM      vmlist.VMInfo
+	Running bool
+}
+
+// WatchVMs sends the running virtual machines and then their changes to ch until done is closed.
+// Changes are noticed from process and Hyper-V WMI events, and by polling every minute.
+func WatchVMs(done <-chan struct{}, ch chan<- VMEvent) {
+	trigger := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	processes := make(chan *ProcessEvent, 1)
+	if pn, err := NewProcessNotify("wslhost.exe", processes); err != nil {
+		println("ProcessNotify error:", err.Error())
+	} else {
+		pn.Start()
+		defer pn.Stop()
+	}
+	type wmiVMEvent struct {
+		Instance struct {
+			Name string
+		} `wmi:"TargetInstance"`
+	}
+	vmEvents := make(chan wmiVMEvent)
+	if q, err := wmi.NewNotificationQuery(vmEvents, vmEventQuery); err == nil {
+		q.SetConnectServerArgs(nil, hyperVNamespace)
+		go func() {
+			if err := q.StartNotifications(); err != nil {
+				println("VM notification error:", err.Error())
+			}
+		}()
+		defer q.Stop()
+	}
+	go func() {
+		for {
+			select {
+			case <-processes:
+			case <-vmEvents:
+			case <-done:
+				return
+			}
+			signal()
+		}
+	}()
+
+	var last []vmlist.VMInfo
+	for {
+		vms := RunningVMs()
+		add, del := vmlist.Diff(last, vms)
+		events := make([]VMEvent, 0, len(add)+len(del))
+		for _, vm := range add {
+			events = append(events, VMEvent{VM: vm, Running: true})
+		}
+		for _, vm := range del {
+			events = append(events, VMEvent{VM: vm, Running: false})
+		}
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			case <-done:
+				return
+			}
+		}
+		last = vms
+		select {
+		case <-done:
+			return
+		case <-trigger:
+		case <-time.After(time.Minute):
+		}
+	}
+}
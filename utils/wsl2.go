@@ -1,10 +1,10 @@
 package utils
 
 import (
-	"strings"
 	"syscall"
 
 	"github.com/bi-zone/wmi"
+	"github.com/buptczq/WinCryptSSHAgent/vmlist"
 	"golang.org/x/sys/windows/registry"
 )
 
@@ -26,34 +26,23 @@ func CheckHVService() bool {
 	return true
 }
 
-func GetVMIDs() []string {
+// wslHostVMIDs returns the VM IDs of WSL2 from the command lines of wslhost.exe.
+func wslHostVMIDs() []string {
 	type Win32_Process struct {
 		CommandLine string
 	}
 	var processes []Win32_Process
 	q := wmi.CreateQuery(&processes, "WHERE Name='wslhost.exe'")
-	err := wmi.Query(q, &processes)
-	if err != nil {
+	if err := wmi.Query(q, &processes); err != nil {
 		return nil
 	}
-
-	guids := make(map[string]interface{})
-
+	ids := make([]string, 0, len(processes))
 	for _, v := range processes {
-		args := strings.Split(v.CommandLine, " ")
-		for i := len(args) - 1; i >= 0; i-- {
-			if strings.Contains(args[i], "{") {
-				guids[args[i]] = nil
-				break
-			}
+		if id := vmlist.ParseWSLHostCommandLine(v.CommandLine); id != "" {
+			ids = append(ids, id)
 		}
 	}
-
-	results := make([]string, 0)
-	for k := range guids {
-		results = append(results, k[1:len(k)-1])
-	}
-	return results
+	return ids
 }
 
 func CheckHvSocket() bool {
@@ -0,0 +1,162 @@
+// Package vmlist parses and compares the lists of running virtual machines found by the agent,
+// independent of the platform.
+package vmlist
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// VMInfo is a running virtual machine which can connect with a Hyper-V socket.
+type VMInfo struct {
+	ID   string
+	Name string
+	// Utility is set for virtual machines not managed by Hyper-V, e.g. WSL2, which need their own listener.
+	Utility bool
+}
+
+// computeSystem is an element of the result of HcsEnumerateComputeSystems.
+type computeSystem struct {
+	Id         string
+	SystemType string
+	Name       string
+	Owner      string
+	RuntimeId  string
+	State      string
+}
+
+// ParseComputeSystems returns the running virtual machines in a result of HcsEnumerateComputeSystems.
+func ParseComputeSystems(data []byte) ([]VMInfo, error) {
+	var systems []computeSystem
+	if err := json.Unmarshal(data, &systems); err != nil {
+		return nil, err
+	}
+	var vms []VMInfo
+	for _, cs := range systems {
+		if cs.SystemType != "VirtualMachine" || (cs.State != "" && cs.State != "Running") {
+			continue
+		}
+		id := cs.RuntimeId
+		if id == "" || id == "00000000-0000-0000-0000-000000000000" {
+			id = cs.Id
+		}
+		id, ok := parseGUID(id)
+		if !ok {
+			continue
+		}
+		vm := VMInfo{ID: id, Name: cs.Name}
+		switch strings.ToUpper(cs.Owner) {
+		case "VMMS":
+		case "WSL":
+			vm.Name, vm.Utility = "WSL", true
+		default:
+			vm.Utility = true
+			if vm.Name == "" {
+				vm.Name = cs.Owner
+			}
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// ParseWSLHostCommandLine returns the VM ID of WSL2 in the command line of wslhost.exe,
+// given with --vm-id or, by older versions, as the last GUID in braces.
+func ParseWSLHostCommandLine(commandLine string) string {
+	args := strings.Fields(commandLine)
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--vm-id" {
+			if id, ok := bracedGUID(args[i+1]); ok {
+				return id
+			}
+		}
+	}
+	for i := len(args) - 1; i >= 0; i-- {
+		if id, ok := bracedGUID(args[i]); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func bracedGUID(s string) (string, bool) {
+	s = strings.Trim(s, "\"")
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return "", false
+	}
+	return parseGUID(s[1 : len(s)-1])
+}
+
+// parseGUID returns s in lower case if it is a GUID in the 8-4-4-4-12 format.
+func parseGUID(s string) (string, bool) {
+	if len(s) != 36 {
+		return "", false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return "", false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return "", false
+			}
+		}
+	}
+	return strings.ToLower(s), true
+}
+
+// Merge returns the running virtual machines from the VM IDs of WSL2 in the command lines of wslhost.exe,
+// which are readable without privileges, the virtual machines of the compute service, which may be nil,
+// and the names of the Hyper-V virtual machines by VM ID.
+func Merge(wsl []string, systems []VMInfo, names map[string]string) []VMInfo {
+	vms := make([]VMInfo, 0, len(wsl)+len(systems)+len(names))
+	seen := make(map[string]bool)
+	for _, vm := range systems {
+		if name, ok := names[vm.ID]; ok {
+			vm.Name = name
+		}
+		seen[vm.ID] = true
+		vms = append(vms, vm)
+	}
+	for _, id := range wsl {
+		if id, ok := parseGUID(id); ok && !seen[id] {
+			seen[id] = true
+			vms = append(vms, VMInfo{ID: id, Name: "WSL", Utility: true})
+		}
+	}
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		vms = append(vms, VMInfo{ID: id, Name: names[id]})
+	}
+	return vms
+}
+
+// Diff returns the virtual machines which are only in new and those only in old.
+func Diff(old, new []VMInfo) (add, del []VMInfo) {
+	oldIDs := make(map[string]bool)
+	newIDs := make(map[string]bool)
+	for _, v := range old {
+		oldIDs[v.ID] = true
+	}
+	for _, v := range new {
+		newIDs[v.ID] = true
+		if !oldIDs[v.ID] {
+			add = append(add, v)
+		}
+	}
+	for _, v := range old {
+		if !newIDs[v.ID] {
+			del = append(del, v)
+		}
+	}
+	return
+}
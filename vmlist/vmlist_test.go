@@ -0,0 +1,102 @@
+package vmlist
+
+import (
+	"reflect"
+	"testing"
+)
+
+// computeSystemsJSON is a result of HcsEnumerateComputeSystems in the schema 1 format of the compute
+// service: a Hyper-V virtual machine, WSL2, Windows Sandbox, a container and a stopped virtual machine.
+const computeSystemsJSON = `[
+{"Id":"8F4C2B0E-6A0D-4B57-9B2C-6E7A3D1F9C11","SystemType":"VirtualMachine","Name":"8F4C2B0E-6A0D-4B57-9B2C-6E7A3D1F9C11","Owner":"VMMS","RuntimeId":"00000000-0000-0000-0000-000000000000","State":"Running","IsRuntimeTemplate":false,"ObRoot":"\\VmSharedMemory\\Partition\\8F4C2B0E"},
+{"Id":"3A1B8C0D-5E2F-4A6B-8C9D-0E1F2A3B4C5D","SystemType":"VirtualMachine","Name":"3A1B8C0D-5E2F-4A6B-8C9D-0E1F2A3B4C5D","Owner":"WSL","RuntimeId":"D7B0C7E2-1C5A-4E89-A2F3-5B6C7D8E9F01","State":"Running","IsRuntimeTemplate":false},
+{"Id":"B2C3D4E5-F6A7-4B8C-9D0E-1F2A3B4C5D6E","SystemType":"VirtualMachine","Name":"","Owner":"CmService","RuntimeId":"B2C3D4E5-F6A7-4B8C-9D0E-1F2A3B4C5D6E","State":"Running","IsRuntimeTemplate":false},
+{"Id":"c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00c0ffee00","SystemType":"Container","Name":"c0ffee00","Owner":"docker","RuntimeId":"00000000-0000-0000-0000-000000000000","State":"Running"},
+{"Id":"11111111-2222-3333-4444-555555555555","SystemType":"VirtualMachine","Name":"11111111-2222-3333-4444-555555555555","Owner":"VMMS","RuntimeId":"","State":"Stopped"},
+{"Id":"not a guid","SystemType":"VirtualMachine","Name":"broken","Owner":"VMMS","State":"Running"}
+]`
+
+func TestParseComputeSystems(t *testing.T) {
+	vms, err := ParseComputeSystems([]byte(computeSystemsJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VMInfo{
+		{ID: "8f4c2b0e-6a0d-4b57-9b2c-6e7a3d1f9c11", Name: "8F4C2B0E-6A0D-4B57-9B2C-6E7A3D1F9C11"},
+		{ID: "d7b0c7e2-1c5a-4e89-a2f3-5b6c7d8e9f01", Name: "WSL", Utility: true},
+		{ID: "b2c3d4e5-f6a7-4b8c-9d0e-1f2a3b4c5d6e", Name: "CmService", Utility: true},
+	}
+	if !reflect.DeepEqual(vms, want) {
+		t.Errorf("ParseComputeSystems() = %+v, want %+v", vms, want)
+	}
+
+	if vms, err := ParseComputeSystems([]byte("[]")); err != nil || len(vms) != 0 {
+		t.Errorf("ParseComputeSystems([]) = %+v, %v, want no virtual machines", vms, err)
+	}
+	if _, err := ParseComputeSystems([]byte(`{"Id":`)); err == nil {
+		t.Error("ParseComputeSystems() of invalid JSON succeeded")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	hyperV := VMInfo{ID: "8f4c2b0e-6a0d-4b57-9b2c-6e7a3d1f9c11", Name: "build"}
+	wsl := VMInfo{ID: "d7b0c7e2-1c5a-4e89-a2f3-5b6c7d8e9f01", Name: "WSL", Utility: true}
+	// WSL2 after a restart, with a new VM ID
+	restarted := VMInfo{ID: "e1f2a3b4-c5d6-4e7f-8a9b-0c1d2e3f4a5b", Name: "WSL", Utility: true}
+
+	tests := []struct {
+		old, new []VMInfo
+		add, del []VMInfo
+	}{
+		{nil, nil, nil, nil},
+		{nil, []VMInfo{hyperV, wsl}, []VMInfo{hyperV, wsl}, nil},
+		{[]VMInfo{hyperV, wsl}, []VMInfo{wsl, hyperV}, nil, nil},
+		{[]VMInfo{hyperV, wsl}, []VMInfo{hyperV}, nil, []VMInfo{wsl}},
+		{[]VMInfo{hyperV, wsl}, []VMInfo{hyperV, restarted}, []VMInfo{restarted}, []VMInfo{wsl}},
+		{[]VMInfo{wsl}, nil, nil, []VMInfo{wsl}},
+	}
+	for i, tt := range tests {
+		add, del := Diff(tt.old, tt.new)
+		if !reflect.DeepEqual(add, tt.add) || !reflect.DeepEqual(del, tt.del) {
+			t.Errorf("%d: Diff() = %+v, %+v, want %+v, %+v", i, add, del, tt.add, tt.del)
+		}
+	}
+}
+
+func TestParseWSLHostCommandLine(t *testing.T) {
+	tests := []struct {
+		commandLine, id string
+	}{
+		{`C:\WINDOWS\system32\wslhost.exe --vm-id {D7B0C7E2-1C5A-4E89-A2F3-5B6C7D8E9F01} --handle 1234`, "d7b0c7e2-1c5a-4e89-a2f3-5b6c7d8e9f01"},
+		{`"C:\Program Files\WSL\wslhost.exe" --distro-id {3A1B8C0D-5E2F-4A6B-8C9D-0E1F2A3B4C5D} --vm-id "{D7B0C7E2-1C5A-4E89-A2F3-5B6C7D8E9F01}"`, "d7b0c7e2-1c5a-4e89-a2f3-5b6c7d8e9f01"},
+		{`wslhost.exe {3A1B8C0D-5E2F-4A6B-8C9D-0E1F2A3B4C5D} {D7B0C7E2-1C5A-4E89-A2F3-5B6C7D8E9F01} 1234 5678`, "d7b0c7e2-1c5a-4e89-a2f3-5b6c7d8e9f01"},
+		{`wslhost.exe --vm-id {not-a-guid}`, ""},
+		{`wslhost.exe`, ""},
+	}
+	for _, tt := range tests {
+		if id := ParseWSLHostCommandLine(tt.commandLine); id != tt.id {
+			t.Errorf("ParseWSLHostCommandLine(%q) = %q, want %q", tt.commandLine, id, tt.id)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	hyperV := VMInfo{ID: "8f4c2b0e-6a0d-4b57-9b2c-6e7a3d1f9c11", Name: "build"}
+	other := VMInfo{ID: "9f4c2b0e-6a0d-4b57-9b2c-6e7a3d1f9c11", Name: "test"}
+	wsl := VMInfo{ID: "d7b0c7e2-1c5a-4e89-a2f3-5b6c7d8e9f01", Name: "WSL", Utility: true}
+	sandbox := VMInfo{ID: "b2c3d4e5-f6a7-4b8c-9d0e-1f2a3b4c5d6e", Name: "CmService", Utility: true}
+	names := map[string]string{other.ID: other.Name, hyperV.ID: hyperV.Name}
+
+	// without the compute service
+	vms := Merge([]string{"D7B0C7E2-1C5A-4E89-A2F3-5B6C7D8E9F01", wsl.ID}, nil, names)
+	if want := []VMInfo{wsl, hyperV, other}; !reflect.DeepEqual(vms, want) {
+		t.Errorf("Merge() = %+v, want %+v", vms, want)
+	}
+
+	// the compute service names Hyper-V virtual machines by their ID
+	systems := []VMInfo{{ID: hyperV.ID, Name: "8F4C2B0E-6A0D-4B57-9B2C-6E7A3D1F9C11"}, wsl, sandbox}
+	vms = Merge([]string{wsl.ID}, systems, names)
+	if want := []VMInfo{hyperV, wsl, sandbox, other}; !reflect.DeepEqual(vms, want) {
+		t.Errorf("Merge() = %+v, want %+v", vms, want)
+	}
+}